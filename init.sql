@@ -182,3 +182,21 @@ CREATE TABLE `locks` (
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+
+USE `engine`;
+
+--
+-- Table structure for table `privacy_tasks`
+--
+
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!50503 SET character_set_client = utf8mb4 */;
+CREATE TABLE IF NOT EXISTS `privacy_tasks` (
+  `id` varchar(64) NOT NULL COMMENT '''task id''',
+  `phase` varchar(32) NOT NULL COMMENT '''current task phase''',
+  `record` longtext NOT NULL COMMENT '''task record serialized as json, callback secret redacted''',
+  `created_at` timestamp(6) NULL DEFAULT NULL,
+  `updated_at` timestamp(6) NULL DEFAULT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/secretflow/scql/pkg/broker/application"
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+	"github.com/secretflow/scql/pkg/util/brokerutil"
+	"github.com/secretflow/scql/pkg/util/message"
+	log "github.com/sirupsen/logrus"
+)
+
+// broker 错误的类型，用 errors.Is 判断
+var (
+	ErrAlreadyExists    = errors.New("already exists")
+	ErrNotFound         = errors.New("not found")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrUnavailable      = errors.New("unavailable")
+	ErrInvalidArgument  = errors.New("invalid argument")
+	ErrConflict         = errors.New("conflict")
+)
+
+// 没有收到 broker 的响应（连接失败、超时、HTTP 状态不是 200 等）
+const codeNoResponse pb.Code = -1
+
+// broker 调用失败：Code 为响应中的状态码，Kind 为按状态码归类的错误类型，无法归类时为 nil
+type BrokerError struct {
+	Op      string
+	Code    pb.Code
+	Message string
+	Kind    error
+}
+
+func (e *BrokerError) Error() string {
+	if e.Code == codeNoResponse {
+		return fmt.Sprintf("%s: failed to call broker: %s", e.Op, e.Message)
+	}
+	return fmt.Sprintf("%s response: status: %d %s, message: %s", e.Op, int32(e.Code), e.Code, e.Message)
+}
+
+func (e *BrokerError) Unwrap() error {
+	return e.Kind
+}
+
+// broker 是否返回了状态（而不是调用失败）
+func (e *BrokerError) Responded() bool {
+	return e.Code != codeNoResponse
+}
+
+var codeKinds = map[pb.Code]error{
+	// 各方的项目状态不一致（CheckAndUpdateStatus），不是已存在，重试也不会成功
+	pb.Code_PROJECT_CONFLICT:      ErrConflict,
+	pb.Code_NOT_FOUND:             ErrNotFound,
+	pb.Code_SESSION_NOT_FOUND:     ErrNotFound,
+	pb.Code_UNAUTHENTICATED:       ErrPermissionDenied,
+	pb.Code_DDL_PERMISSION_DENIED: ErrPermissionDenied,
+	pb.Code_CCL_CHECK_FAILED:      ErrPermissionDenied,
+	pb.Code_BAD_REQUEST:           ErrInvalidArgument,
+	pb.Code_INVALID_ARGUMENT:      ErrInvalidArgument,
+	pb.Code_SQL_PARSE_ERROR:       ErrInvalidArgument,
+	pb.Code_NOT_SUPPORTED:         ErrInvalidArgument,
+	pb.Code_NOT_READY:             ErrUnavailable,
+}
+
+// broker 把处理函数返回的普通错误（fmt.Errorf）都报告为 INTERNAL，以下情况没有单独的状态码，
+// 只能按接口和消息归类；归类时记录日志，broker 改变措辞时表现为无法归类的错误
+type internalKind struct {
+	substr string
+	kind   error
+}
+
+var internalKinds = map[string][]internalKind{
+	"CreateProject": {
+		{"already exists", ErrAlreadyExists},
+	},
+	"CreateTable": {
+		{"already exists", ErrAlreadyExists},
+	},
+	"InviteMember": {
+		{"already contains invitee", ErrAlreadyExists},
+		{"not equal to selfParty", ErrPermissionDenied}, // 不是项目的创建方
+		{"failed to invite party", ErrUnavailable},      // 对方 broker 不可达
+	},
+	"ProcessInvitation": {
+		{"record not found", ErrNotFound}, // 邀请已被处理
+		{"connection refused", ErrUnavailable},
+		{"context deadline exceeded", ErrUnavailable},
+	},
+}
+
+func classifyStatus(op string, code pb.Code, msg string) error {
+	if kind, ok := codeKinds[code]; ok {
+		return kind
+	}
+	if code != pb.Code_INTERNAL {
+		return nil
+	}
+	for _, k := range internalKinds[op] {
+		if strings.Contains(msg, k.substr) {
+			log.Warnf("%s: classify INTERNAL status as %v by message %q: %s", op, k.kind, k.substr, msg)
+			return k.kind
+		}
+	}
+	return nil
+}
+
+// 把调用错误和响应状态转换为 *BrokerError，成功时返回 nil；okCodes 为视为成功的其他状态码
+func brokerStatus(op string, callErr error, status *pb.Status, okCodes ...pb.Code) error {
+	if callErr != nil {
+		return &BrokerError{Op: op, Code: codeNoResponse, Message: callErr.Error(), Kind: ErrUnavailable}
+	}
+	if status == nil {
+		return &BrokerError{Op: op, Code: codeNoResponse, Message: "invalid response: status is nil", Kind: ErrUnavailable}
+	}
+	code := pb.Code(status.GetCode())
+	if code == pb.Code_OK {
+		return nil
+	}
+	for _, c := range okCodes {
+		if code == c {
+			return nil
+		}
+	}
+	return &BrokerError{Op: op, Code: code, Message: status.GetMessage(), Kind: classifyStatus(op, code, status.GetMessage())}
+}
+
+// 包装 brokerutil.Command：用到的接口直接调用 intra API，失败时返回 *BrokerError；
+// 其余接口沿用 brokerutil.Command
+type brokerClient struct {
+	*brokerutil.Command
+	host string
+	stub application.IntraStub
+}
+
+func newBrokerClient(host string, timeoutS int) *brokerClient {
+	return &brokerClient{
+		Command: brokerutil.NewCommand(host, timeoutS),
+		host:    host,
+		stub:    application.IntraStub{Timeout: time.Duration(timeoutS) * time.Second},
+	}
+}
+
+func (c *brokerClient) CreateProject(projectID, projectConf string) (string, error) {
+	var conf pb.ProjectConfig
+	if err := message.ProtoUnmarshal([]byte(projectConf), &conf); err != nil {
+		return "", &BrokerError{Op: "CreateProject", Code: pb.Code_BAD_REQUEST, Message: "deserialize project config: " + err.Error(), Kind: ErrInvalidArgument}
+	}
+	resp := &pb.CreateProjectResponse{}
+	err := c.stub.CreateProject(c.host, &pb.CreateProjectRequest{ProjectId: projectID, Conf: &conf}, resp)
+	if err := brokerStatus("CreateProject", err, resp.GetStatus()); err != nil {
+		return "", err
+	}
+	return resp.GetProjectId(), nil
+}
+
+func (c *brokerClient) ArchiveProject(projectID string) (string, error) {
+	resp := &pb.ArchiveProjectResponse{}
+	err := c.stub.ArchiveProject(c.host, &pb.ArchiveProjectRequest{ProjectId: projectID}, resp)
+	if err := brokerStatus("ArchiveProject", err, resp.GetStatus()); err != nil {
+		return "", err
+	}
+	return resp.GetStatus().GetMessage(), nil
+}
+
+func (c *brokerClient) DeleteProject(projectID string) error {
+	resp := &pb.DeleteProjectResponse{}
+	err := c.stub.DeleteProject(c.host, &pb.DeleteProjectRequest{ProjectId: projectID}, resp)
+	return brokerStatus("DeleteProject", err, resp.GetStatus())
+}
+
+func (c *brokerClient) GetProject(projectID string) (*pb.ListProjectsResponse, error) {
+	req := &pb.ListProjectsRequest{}
+	if projectID != "" {
+		req.Ids = []string{projectID}
+	}
+	resp := &pb.ListProjectsResponse{}
+	err := c.stub.ListProjects(c.host, req, resp)
+	if err := brokerStatus("GetProject", err, resp.GetStatus()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *brokerClient) InviteMember(projectID, member string) error {
+	resp := &pb.InviteMemberResponse{}
+	err := c.stub.InviteMember(c.host, &pb.InviteMemberRequest{ProjectId: projectID, Invitee: member}, resp)
+	return brokerStatus("InviteMember", err, resp.GetStatus())
+}
+
+func (c *brokerClient) GetInvitation() (*pb.ListInvitationsResponse, error) {
+	resp := &pb.ListInvitationsResponse{}
+	err := c.stub.ListInvitations(c.host, &pb.ListInvitationsRequest{}, resp)
+	if err := brokerStatus("GetInvitation", err, resp.GetStatus()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *brokerClient) ProcessInvitation(ids string, accept bool) error {
+	id, err := strconv.ParseUint(ids, 10, 64)
+	if err != nil {
+		return &BrokerError{Op: "ProcessInvitation", Code: pb.Code_BAD_REQUEST, Message: "invalid invitation id " + ids, Kind: ErrInvalidArgument}
+	}
+	respond := pb.InvitationRespond_DECLINE
+	if accept {
+		respond = pb.InvitationRespond_ACCEPT
+	}
+	resp := &pb.ProcessInvitationResponse{}
+	err = c.stub.ProcessInvitation(c.host, &pb.ProcessInvitationRequest{InvitationId: id, Respond: respond}, resp)
+	return brokerStatus("ProcessInvitation", err, resp.GetStatus())
+}
+
+func (c *brokerClient) CreateTable(projectID, tableName, dbType, refTable string, columns []*pb.CreateTableRequest_ColumnDesc) error {
+	req := &pb.CreateTableRequest{
+		ProjectId: projectID,
+		TableName: tableName,
+		DbType:    dbType,
+		RefTable:  refTable,
+		Columns:   columns,
+	}
+	resp := &pb.CreateTableResponse{}
+	err := c.stub.CreateTable(c.host, req, resp)
+	return brokerStatus("CreateTable", err, resp.GetStatus())
+}
+
+func (c *brokerClient) DeleteTable(projectID, name string) error {
+	resp := &pb.DropTableResponse{}
+	err := c.stub.DropTable(c.host, &pb.DropTableRequest{ProjectId: projectID, TableName: name}, resp)
+	return brokerStatus("DeleteTable", err, resp.GetStatus())
+}
+
+func (c *brokerClient) GetTable(projectID string, tableNames []string) (*pb.ListTablesResponse, error) {
+	resp := &pb.ListTablesResponse{}
+	err := c.stub.ListTables(c.host, &pb.ListTablesRequest{ProjectId: projectID, Names: tableNames}, resp)
+	if err := brokerStatus("GetTable", err, resp.GetStatus()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *brokerClient) GrantCCL(projectID string, ccls []*pb.ColumnControl) error {
+	resp := &pb.GrantCCLResponse{}
+	err := c.stub.GrantCCL(c.host, &pb.GrantCCLRequest{ProjectId: projectID, ColumnControlList: ccls}, resp)
+	return brokerStatus("GrantCCL", err, resp.GetStatus())
+}
+
+// 撤销的授权对象由 ccls 中的 PartyCode 指定
+func (c *brokerClient) RevokeCCL(projectID string, ccls []*pb.ColumnControl) error {
+	resp := &pb.RevokeCCLResponse{}
+	err := c.stub.RevokeCCL(c.host, &pb.RevokeCCLRequest{ProjectId: projectID, ColumnControlList: ccls}, resp)
+	return brokerStatus("RevokeCCL", err, resp.GetStatus())
+}
+
+func (c *brokerClient) GetCCL(projectID string, tables, destParties []string) (*pb.ShowCCLResponse, error) {
+	resp := &pb.ShowCCLResponse{}
+	err := c.stub.ListCCLs(c.host, &pb.ShowCCLRequest{ProjectId: projectID, Tables: tables, DestParties: destParties}, resp)
+	if err := brokerStatus("GetCCL", err, resp.GetStatus()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func queryRequest(op, projectID, query string, debugOpts *pb.DebugOptions, jobConf string) (*pb.QueryRequest, error) {
+	var conf pb.JobConfig
+	if err := message.ProtoUnmarshal([]byte(jobConf), &conf); err != nil {
+		return nil, &BrokerError{Op: op, Code: pb.Code_BAD_REQUEST, Message: "deserialize job config: " + err.Error(), Kind: ErrInvalidArgument}
+	}
+	return &pb.QueryRequest{ProjectId: projectID, Query: query, DebugOpts: debugOpts, JobConfig: &conf}, nil
+}
+
+func (c *brokerClient) DoQuery(projectID, query string, debugOpts *pb.DebugOptions, jobConf string) (*pb.QueryResponse, error) {
+	req, err := queryRequest("DoQuery", projectID, query, debugOpts, jobConf)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.QueryResponse{}
+	err = c.stub.RunQuery(c.host, req, resp)
+	if err := brokerStatus("DoQuery", err, resp.GetStatus()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// jobID 为空时由 broker 生成
+func (c *brokerClient) CreateJob(projectID, jobID, query string, debugOpts *pb.DebugOptions, jobConf string) (string, error) {
+	req, err := queryRequest("CreateJob", projectID, query, debugOpts, jobConf)
+	if err != nil {
+		return "", err
+	}
+	req.JobId = jobID
+	resp := &pb.SubmitResponse{}
+	err = c.stub.CreateJob(c.host, req, resp)
+	if err := brokerStatus("CreateJob", err, resp.GetStatus()); err != nil {
+		return "", err
+	}
+	return resp.GetJobId(), nil
+}
+
+// 作业未完成时 Status.Code 为 NOT_READY，不视为错误
+func (c *brokerClient) GetResult(jobID string) (*pb.FetchResultResponse, error) {
+	resp := &pb.FetchResultResponse{}
+	err := c.stub.GetResult(c.host, &pb.FetchResultRequest{JobId: jobID}, resp)
+	if err := brokerStatus("GetResult", err, resp.GetStatus(), pb.Code_NOT_READY); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *brokerClient) CancelJob(jobID string) error {
+	resp := &pb.CancelQueryResponse{}
+	err := c.stub.CancelJob(c.host, &pb.CancelQueryRequest{JobId: jobID}, resp)
+	return brokerStatus("CancelJob", err, resp.GetStatus())
+}
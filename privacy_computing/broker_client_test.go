@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+)
+
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		op   string
+		code pb.Code
+		msg  string
+		want error
+	}{
+		{"CreateProject", pb.Code_PROJECT_CONFLICT, "", ErrConflict},
+		{"GetResult", pb.Code_NOT_FOUND, "", ErrNotFound},
+		{"GetResult", pb.Code_SESSION_NOT_FOUND, "", ErrNotFound},
+		{"DoQuery", pb.Code_UNAUTHENTICATED, "", ErrPermissionDenied},
+		{"DoQuery", pb.Code_CCL_CHECK_FAILED, "", ErrPermissionDenied},
+		{"DoQuery", pb.Code_SQL_PARSE_ERROR, "", ErrInvalidArgument},
+		{"GetResult", pb.Code_NOT_READY, "", ErrUnavailable},
+		// 只有 INTERNAL 按接口和消息归类
+		{"CreateProject", pb.Code_INTERNAL, "CreateProject: project p1 already exists", ErrAlreadyExists},
+		{"CreateTable", pb.Code_INTERNAL, "CreateTable: table t already exists owned by alice", ErrAlreadyExists},
+		{"InviteMember", pb.Code_INTERNAL, "InviteMember: project already contains invitee{bob}", ErrAlreadyExists},
+		{"InviteMember", pb.Code_INTERNAL, "InviteMember: project creator{alice} not equal to selfParty{bob}", ErrPermissionDenied},
+		{"InviteMember", pb.Code_INTERNAL, "InviteMember: failed to invite party bob for project p1: timeout", ErrUnavailable},
+		{"ProcessInvitation", pb.Code_INTERNAL, "record not found", ErrNotFound},
+		{"ProcessInvitation", pb.Code_INTERNAL, "dial tcp: connection refused", ErrUnavailable},
+		{"ProcessInvitation", pb.Code_INTERNAL, "context deadline exceeded", ErrUnavailable},
+		{"InviteMember", pb.Code_INTERNAL, "unexpected", nil},
+		// 其他接口的相同消息不归类
+		{"DoQuery", pb.Code_INTERNAL, "table t already exists", nil},
+		{"GetResult", pb.Code_INTERNAL, "record not found", nil},
+		{"CreateProject", pb.Code_INTERNAL, "already contains invitee bob", nil},
+		{"CreateProject", pb.Code_BAD_REQUEST, "already exists", ErrInvalidArgument},
+		{"ProcessInvitation", pb.Code_UNKNOWN_ENGINE_ERROR, "connection refused", nil},
+	}
+	for _, tt := range tests {
+		if got := classifyStatus(tt.op, tt.code, tt.msg); got != tt.want {
+			t.Errorf("classifyStatus(%s, %s, %q) = %v, want %v", tt.op, tt.code, tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestBrokerStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		callErr   error
+		status    *pb.Status
+		okCodes   []pb.Code
+		want      error
+		responded bool
+	}{
+		{"ok", nil, &pb.Status{Code: int32(pb.Code_OK)}, nil, nil, false},
+		{"ok code", nil, &pb.Status{Code: int32(pb.Code_NOT_READY)}, []pb.Code{pb.Code_NOT_READY}, nil, false},
+		{"call error", errors.New("timeout"), nil, nil, ErrUnavailable, false},
+		{"nil status", nil, nil, nil, ErrUnavailable, false},
+		{"classified", nil, &pb.Status{Code: int32(pb.Code_NOT_FOUND), Message: "no project"}, nil, ErrNotFound, true},
+	}
+	for _, tt := range tests {
+		err := brokerStatus("op", tt.callErr, tt.status, tt.okCodes...)
+		if tt.want == nil {
+			if err != nil {
+				t.Errorf("%s: err = %v, want nil", tt.name, err)
+			}
+			continue
+		}
+		var be *BrokerError
+		if !errors.As(err, &be) || !errors.Is(err, tt.want) || be.Responded() != tt.responded {
+			t.Errorf("%s: err = %#v, want kind %v, responded %v", tt.name, err, tt.want, tt.responded)
+		}
+	}
+}
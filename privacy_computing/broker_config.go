@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// broker 配置模板与渲染结果，模板不会被改写
+var (
+	brokerConfigTemplate = "/home/user/config/templates/config.yml"
+	brokerConfigFile     = "/home/user/config/config.yml"
+	partyInfoFile        = "/home/user/config/party_info.json"
+)
+
+var partyCodeRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// party_info.json 中的参与方
+type PartyInfo struct {
+	PartyCode string `json:"party_code"`
+	Endpoint  string `json:"endpoint"`
+	Pubkey    string `json:"pubkey"`
+}
+
+// 渲染 broker 配置所需的数据
+type BrokerConfig struct {
+	PartyCode    string
+	EngineURL    string
+	Participants []PartyInfo
+}
+
+func (c *BrokerConfig) Validate() error {
+	if !partyCodeRe.MatchString(c.PartyCode) {
+		return fmt.Errorf("invalid party code %q", c.PartyCode)
+	}
+	if err := validateEngineURL(c.EngineURL); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, p := range c.Participants {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if seen[p.PartyCode] {
+			return fmt.Errorf("duplicate party %s", p.PartyCode)
+		}
+		seen[p.PartyCode] = true
+	}
+	if !seen[c.PartyCode] {
+		return fmt.Errorf("party %s missing from participants", c.PartyCode)
+	}
+	return nil
+}
+
+// engine 地址写入 YAML 字符串，只允许 host:port 或 http(s) URL
+func validateEngineURL(engineURL string) error {
+	if strings.ContainsAny(engineURL, "\"\\ \t\r\n") {
+		return fmt.Errorf("invalid engine url %q", engineURL)
+	}
+	if strings.Contains(engineURL, "://") {
+		u, err := url.Parse(engineURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid engine url %q", engineURL)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(engineURL); err != nil {
+		return fmt.Errorf("invalid engine url %q: %v", engineURL, err)
+	}
+	return nil
+}
+
+func (p *PartyInfo) Validate() error {
+	if !partyCodeRe.MatchString(p.PartyCode) {
+		return fmt.Errorf("invalid party code %q", p.PartyCode)
+	}
+	u, err := url.Parse(p.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q for party %s", p.Endpoint, p.PartyCode)
+	}
+	if _, err := base64.StdEncoding.DecodeString(p.Pubkey); err != nil || p.Pubkey == "" {
+		return fmt.Errorf("invalid pubkey for party %s", p.PartyCode)
+	}
+	return nil
+}
+
+// 各任务的参与方：并发任务的协作方不同，渲染时包含其他执行中任务的参与方，避免相互覆盖；
+// 任务开始执行时登记，结束（SUCCEEDED / FAILED / CANCELLED）时移除，下次渲染时不再包含
+var (
+	partiesMu     sync.Mutex
+	activeParties = map[string]taskParties{}
+)
+
+type taskParties struct {
+	self    string
+	parties []PartyInfo
+}
+
+// 请求中的参与方（本节点在前）
+func requestParties(req *RunPrivacyRequest) []PartyInfo {
+	parties := []PartyInfo{{PartyCode: req.User, Endpoint: req.UserURL, Pubkey: req.UserKey}}
+	for _, p := range req.partners() {
+		parties = append(parties, PartyInfo{PartyCode: p.User, Endpoint: p.PartyURL, Pubkey: p.PubKey})
+	}
+	return parties
+}
+
+// 提交任务时校验请求中的网络配置
+func validateBrokerConfig(req *RunPrivacyRequest) error {
+	conf := &BrokerConfig{PartyCode: req.User, EngineURL: req.EngineURL, Participants: requestParties(req)}
+	return conf.Validate()
+}
+
+// 根据请求生成 broker 配置数据，包含其他执行中任务的参与方；本任务的参与方一直保留到 forgetParties
+func brokerConfigFromRequest(taskID string, req *RunPrivacyRequest) *BrokerConfig {
+	partiesMu.Lock()
+	defer partiesMu.Unlock()
+
+	activeParties[taskID] = taskParties{self: req.User, parties: requestParties(req)}
+	merged := make(map[string]PartyInfo)
+	for id, tp := range activeParties {
+		// 本节点身份不同的任务的参与方不再有效
+		if id == taskID || tp.self != req.User {
+			continue
+		}
+		for _, p := range tp.parties {
+			merged[p.PartyCode] = p
+		}
+	}
+	// 本任务的参与方优先
+	for _, p := range activeParties[taskID].parties {
+		merged[p.PartyCode] = p
+	}
+
+	conf := &BrokerConfig{PartyCode: req.User, EngineURL: req.EngineURL}
+	for _, p := range merged {
+		conf.Participants = append(conf.Participants, p)
+	}
+	// 本节点在前，其余按 party code 排序，保证渲染结果稳定
+	sort.Slice(conf.Participants, func(i, j int) bool {
+		a, b := conf.Participants[i], conf.Participants[j]
+		if (a.PartyCode == req.User) != (b.PartyCode == req.User) {
+			return a.PartyCode == req.User
+		}
+		return a.PartyCode < b.PartyCode
+	})
+	return conf
+}
+
+// 任务结束后移除其参与方
+func forgetParties(taskID string) {
+	partiesMu.Lock()
+	defer partiesMu.Unlock()
+	delete(activeParties, taskID)
+}
+
+// 渲染 config.yml 和 party_info.json，返回配置是否有变化
+func renderBrokerConfig(conf *BrokerConfig) (bool, error) {
+	if err := conf.Validate(); err != nil {
+		return false, err
+	}
+
+	tmpl, err := template.New(filepath.Base(brokerConfigTemplate)).Option("missingkey=error").ParseFiles(brokerConfigTemplate)
+	if err != nil {
+		return false, err
+	}
+	var configYml bytes.Buffer
+	if err := tmpl.Execute(&configYml, conf); err != nil {
+		return false, err
+	}
+
+	partyInfo, err := json.MarshalIndent(map[string]any{"participants": conf.Participants}, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	partyInfo = append(partyInfo, '\n')
+
+	changed := false
+	for _, f := range []struct {
+		path string
+		data []byte
+	}{
+		{brokerConfigFile, configYml.Bytes()},
+		{partyInfoFile, partyInfo},
+	} {
+		fileChanged, err := writeIfChanged(f.path, f.data)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || fileChanged
+	}
+	return changed, nil
+}
+
+// 内容不同时写入文件并记录差异
+func writeIfChanged(path string, data []byte) (bool, error) {
+	old, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	if bytes.Equal(old, data) {
+		return false, nil
+	}
+	log.Infof("%s changed:\n%s", path, diffLines(string(old), string(data)))
+
+	// 先写临时文件再替换，避免 broker 读到写了一半的配置
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// 逐行比较，输出 -/+ 格式的差异
+func diffLines(a, b string) string {
+	x := strings.Split(a, "\n")
+	y := strings.Split(b, "\n")
+
+	// 最长公共子序列
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			i++
+			j++
+		case j < len(y) && (i == len(x) || lcs[i][j+1] >= lcs[i+1][j]):
+			fmt.Fprintf(&out, "+ %s\n", y[j])
+			j++
+		default:
+			fmt.Fprintf(&out, "- %s\n", x[i])
+			i++
+		}
+	}
+	return out.String()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"same", "a\nb", "a\nb", ""},
+		{"added", "a\nc", "a\nb\nc", "+ b\n"},
+		{"removed", "a\nb\nc", "a\nc", "- b\n"},
+		{"changed", "port: 1\nhost: x", "port: 2\nhost: x", "+ port: 2\n- port: 1\n"},
+		{"from empty", "", "a", "+ a\n- \n"},
+		{"trailing newline", "a\n", "a\nb\n", "+ b\n"},
+	}
+	for _, tt := range tests {
+		if got := diffLines(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: diffLines = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBrokerConfigParties(t *testing.T) {
+	saved := activeParties
+	activeParties = map[string]taskParties{}
+	t.Cleanup(func() { activeParties = saved })
+
+	request := func(self string, partners ...string) *RunPrivacyRequest {
+		req := &RunPrivacyRequest{User: self, UserURL: "http://" + self}
+		for _, p := range partners {
+			req.Parties = append(req.Parties, Party{User: p, PartyURL: "http://" + p})
+		}
+		return req
+	}
+	codes := func(conf *BrokerConfig) []string {
+		var out []string
+		for _, p := range conf.Participants {
+			out = append(out, p.PartyCode)
+		}
+		return out
+	}
+
+	steps := []struct {
+		name   string
+		run    func() *BrokerConfig
+		want   []string
+		bobURL string // bob 的 endpoint
+	}{
+		{"first task", func() *BrokerConfig { return brokerConfigFromRequest("t1", request("alice", "carol")) }, []string{"alice", "carol"}, ""},
+		{"merges running task", func() *BrokerConfig {
+			return brokerConfigFromRequest("t2", request("alice", "dave", "bob"))
+		}, []string{"alice", "bob", "carol", "dave"}, "http://bob"},
+		{"other identity ignored", func() *BrokerConfig { return brokerConfigFromRequest("t3", request("zed", "bob")) }, []string{"zed", "bob"}, "http://bob"},
+		{"own parties win", func() *BrokerConfig {
+			req := request("alice", "bob")
+			req.Parties[0].PartyURL = "https://bob2"
+			return brokerConfigFromRequest("t4", req)
+		}, []string{"alice", "bob", "carol", "dave"}, "https://bob2"},
+		{"forgotten tasks dropped", func() *BrokerConfig {
+			forgetParties("t1")
+			forgetParties("t2")
+			return brokerConfigFromRequest("t4", request("alice", "bob"))
+		}, []string{"alice", "bob"}, "http://bob"},
+	}
+	for _, step := range steps {
+		conf := step.run()
+		if got := codes(conf); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: participants = %q, want %q", step.name, got, step.want)
+		}
+		for _, p := range conf.Participants {
+			if p.PartyCode == "bob" && p.Endpoint != step.bobURL {
+				t.Errorf("%s: bob endpoint = %s, want %s", step.name, p.Endpoint, step.bobURL)
+			}
+		}
+	}
+}
+
+// 重启失败或等待重启时任务结束，配置文件已更新而 broker 未重启，之后的任务仍需重启
+func TestPrepareConfigureRestartPending(t *testing.T) {
+	dir := t.TempDir()
+	savedTemplate, savedConfig, savedPartyInfo := brokerConfigTemplate, brokerConfigFile, partyInfoFile
+	savedParties, savedPending := activeParties, brokerRestartPending
+	brokerConfigTemplate = filepath.Join(dir, "template.yml")
+	brokerConfigFile = filepath.Join(dir, "config.yml")
+	partyInfoFile = filepath.Join(dir, "party_info.json")
+	activeParties = map[string]taskParties{}
+	brokerRestartPending = false
+	t.Cleanup(func() {
+		brokerConfigTemplate, brokerConfigFile, partyInfoFile = savedTemplate, savedConfig, savedPartyInfo
+		activeParties, brokerRestartPending = savedParties, savedPending
+	})
+	if err := os.WriteFile(brokerConfigTemplate, []byte("party_code: {{.PartyCode}}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &RunPrivacyRequest{
+		User: "alice", UserURL: "http://alice:8080", UserKey: "YQ==", EngineURL: "engine:8003",
+		Parties: []Party{{User: "bob", PartyURL: "http://bob:8080", PubKey: "Yg=="}},
+	}
+	steps := []struct {
+		name        string
+		taskID      string
+		restarted   bool // 独占 broker 后是否重启成功
+		wantRestart bool
+	}{
+		{"config changed", "t1", false, true},
+		{"restart failed earlier", "t2", true, true},
+		{"applied", "t3", false, false},
+	}
+	for _, step := range steps {
+		r := &taskRunner{taskID: step.taskID, req: req}
+		if err := r.prepareConfigure(t.Context()); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if r.brokerExclusive != step.wantRestart {
+			t.Errorf("%s: restart = %v, want %v", step.name, r.brokerExclusive, step.wantRestart)
+		}
+		if step.restarted {
+			brokerConfigMu.Lock()
+			brokerRestartPending = false
+			brokerConfigMu.Unlock()
+		}
+		r.releaseBroker()
+		forgetParties(step.taskID)
+	}
+	// 等待期间其他任务已重启 broker，不再重启
+	if err := (&taskRunner{taskID: "t4", req: req}).restartBroker(t.Context()); err != nil {
+		t.Errorf("restart when applied: %v", err)
+	}
+}
@@ -1,28 +1,51 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"os"
+	"strconv"
 
-	"github.com/olekukonko/tablewriter"
 	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
-	"github.com/secretflow/scql/pkg/util/brokerutil"
-	"github.com/secretflow/scql/pkg/util/tableview"
 	log "github.com/sirupsen/logrus"
 )
 
-var brokerCommand *brokerutil.Command
+var brokerCommand *brokerClient
 
 // func init() {
 // 	brokerCommand = brokerutil.NewCommand("http://127.0.0.1:8080", 5)
 // }
 
-var projectConf = `{"spu_runtime_cfg":{"protocol":"SEMI2K","field":"FM64"},"session_expire_seconds":"86400"}`
-var projectID = "tsql"
+// brokerutil.Command 不支持 context，在 goroutine 中调用，ctx 结束时立即返回
+func brokerCall[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	type result struct {
+		val T
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		val, err := fn()
+		ch <- result{val, err}
+	}()
+	select {
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	case r := <-ch:
+		return r.val, r.err
+	}
+}
+
+func brokerExec(ctx context.Context, fn func() error) error {
+	_, err := brokerCall(ctx, func() (struct{}, error) {
+		return struct{}{}, fn()
+	})
+	return err
+}
 
-func createProject() error {
-	_, err := brokerCommand.CreateProject(projectID, projectConf)
+func createProject(ctx context.Context, projectID, conf string) error {
+	_, err := brokerCall(ctx, func() (string, error) {
+		return brokerCommand.CreateProject(projectID, conf)
+	})
 	if err != nil {
 		return err
 	}
@@ -30,8 +53,10 @@ func createProject() error {
 	return nil
 }
 
-func inviteMember(member string) error {
-	err := brokerCommand.InviteMember(projectID, member)
+func inviteMember(ctx context.Context, projectID, member string) error {
+	err := brokerExec(ctx, func() error {
+		return brokerCommand.InviteMember(projectID, member)
+	})
 	if err != nil {
 		return err
 	}
@@ -39,63 +64,56 @@ func inviteMember(member string) error {
 	return nil
 }
 
-// 检查成员 member 是否加入项目
-func ProjectMemberJoined(member string) (bool, error) {
-	response, err := brokerCommand.GetProject(projectID)
+// 查询已加入项目的成员
+func ProjectMembers(ctx context.Context, projectID string) ([]string, error) {
+	response, err := brokerCall(ctx, func() (*pb.ListProjectsResponse, error) {
+		return brokerCommand.GetProject(projectID)
+	})
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	if len(response.GetProjects()) == 0 {
-		return false, errors.New("not get project")
-	}
-	project := response.GetProjects()[0]
-	for _, mem := range project.Members {
-		if mem == member {
-			return true, nil
-		}
-	}
-	return false, nil
-}
-
-// 查看邀请--同意
-func JoinProject() (bool, error) {
-	response, err := brokerCommand.GetInvitation()
-	if err != nil {
-		return false, err
-	}
-	if len(response.Invitations) > 0 {
-		invitation := response.Invitations[0]
-		err = processInvitation(fmt.Sprintf("%d", invitation.InvitationId))
-		if err != nil {
-			return false, err
-		} else {
-			return true, nil
-		}
-	} else {
-		return false, nil
+		return nil, fmt.Errorf("project %s: %w", projectID, ErrNotFound)
 	}
+	return response.GetProjects()[0].GetMembers(), nil
 }
 
-// 同意邀请
-func processInvitation(ids string) error {
-	accept := true
-	err := brokerCommand.ProcessInvitation(ids, accept)
+// 接受或拒绝邀请
+func processInvitation(ctx context.Context, id uint64, accept bool) error {
+	err := brokerExec(ctx, func() error {
+		return brokerCommand.ProcessInvitation(strconv.FormatUint(id, 10), accept)
+	})
 	if err != nil {
 		return err
 	}
-	log.Printf("process invitation %v succeeded\n", ids)
+	log.Printf("process invitation %v (accept=%v) succeeded\n", id, accept)
 	return nil
 }
 
-func createTable(req *RunPrivacyRequest) error {
+// 在项目中创建表 req.User，对应 MySQL 中的 engine.refTable；列名和类型取自导入结果 dataset
+func createTable(ctx context.Context, projectID, refTable string, req *RunPrivacyRequest, dataset *DatasetReport) error {
+	dtypes := dataset.columnTypes()
 	var columnDescs []*pb.CreateTableRequest_ColumnDesc
 	for _, column := range req.Columns {
+		name := dataset.columnName(column.Column)
+		if name == "" {
+			name = column.Column
+		}
+		dtype := dtypes[name]
+		if dtype == "" {
+			dtype, _ = normalizeDtype(column.Type)
+		}
+		if dtype == "" {
+			dtype = DtypeString
+		}
 		columnDescs = append(columnDescs, &pb.CreateTableRequest_ColumnDesc{
-			Name:  column.Column,
-			Dtype: column.Type,
+			Name:  name,
+			Dtype: dtype,
 		})
 	}
-	err := brokerCommand.CreateTable(projectID, req.User, "mysql", "engine."+req.User, columnDescs)
+	err := brokerExec(ctx, func() error {
+		return brokerCommand.CreateTable(projectID, req.User, "mysql", "engine."+refTable, columnDescs)
+	})
 	if err != nil {
 		log.Debug(err)
 		return err
@@ -104,7 +122,7 @@ func createTable(req *RunPrivacyRequest) error {
 	return nil
 }
 
-func grantCCL(party, tableName, colName, constraint string) error {
+func grantCCL(ctx context.Context, projectID, party, tableName, colName, constraint string) error {
 	value, ok := pb.Constraint_value[constraint]
 	if !ok {
 		return fmt.Errorf("not support constraint %v", constraint)
@@ -119,7 +137,9 @@ func grantCCL(party, tableName, colName, constraint string) error {
 		Constraint: pb.Constraint(value),
 	})
 
-	err := brokerCommand.GrantCCL(projectID, ccls)
+	err := brokerExec(ctx, func() error {
+		return brokerCommand.GrantCCL(projectID, ccls)
+	})
 	if err != nil {
 		return err
 	}
@@ -127,26 +147,26 @@ func grantCCL(party, tableName, colName, constraint string) error {
 	return nil
 }
 
-func runQuery(query, filename string) error {
-	response, err := brokerCommand.DoQuery(projectID, query, &pb.DebugOptions{EnablePsiDetailLog: false}, "{}")
+// 同步执行查询，返回查询结果
+func runQuery(ctx context.Context, projectID, query, jobConf string) (*pb.QueryResult, error) {
+	response, err := brokerCall(ctx, func() (*pb.QueryResponse, error) {
+		return brokerCommand.DoQuery(projectID, query, &pb.DebugOptions{EnablePsiDetailLog: false}, jobConf)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if len(response.Result.OutColumns) > 0 {
-		f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		table := tablewriter.NewWriter(f)
-		table.SetAutoWrapText(false)
-		table.SetAutoFormatHeaders(false)
-		if err := tableview.ConvertToTable(response.Result.GetOutColumns(), table); err != nil {
-			log.Debugf("[fetch]convertToTable with err:%v\n", err)
-		}
-		log.Debugf("%v rows in set: (%vs)\n", table.NumLines(), response.Result.GetCostTimeS())
-		table.Render()
+	log.Debugf("run query succeeded: (%vs)", response.GetResult().GetCostTimeS())
+	return response.GetResult(), nil
+}
+
+// 清理任务中途创建的项目和表：发起方删除项目，协作方删除自己的表
+func cleanupProject(ctx context.Context, projectID string, req *RunPrivacyRequest) error {
+	if req.RunSQL != "" {
+		return brokerExec(ctx, func() error {
+			return brokerCommand.DeleteProject(projectID)
+		})
 	}
-	log.Debug("run query succeeded")
-	return nil
+	return brokerExec(ctx, func() error {
+		return brokerCommand.DeleteTable(projectID, req.User)
+	})
 }
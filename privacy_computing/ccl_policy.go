@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+)
+
+// CCL 策略模板：关联键和其余列的默认约束
+const (
+	CCLTemplateJoinKeys  = "join_keys"      // 关联键 PLAINTEXT_AFTER_JOIN，其余列 ENCRYPTED_ONLY
+	CCLTemplateAggregate = "aggregate"      // 关联键 PLAINTEXT_AFTER_JOIN，其余列 PLAINTEXT_AFTER_AGGREGATE
+	CCLTemplateEncrypted = "encrypted_only" // 所有列 ENCRYPTED_ONLY
+)
+
+var cclTemplates = map[string]struct {
+	JoinKey string
+	Other   string
+}{
+	CCLTemplateJoinKeys:  {"PLAINTEXT_AFTER_JOIN", "ENCRYPTED_ONLY"},
+	CCLTemplateAggregate: {"PLAINTEXT_AFTER_JOIN", "PLAINTEXT_AFTER_AGGREGATE"},
+	CCLTemplateEncrypted: {"ENCRYPTED_ONLY", "ENCRYPTED_ONLY"},
+}
+
+// 通配符，匹配所有协作方或所有列
+const cclWildcard = "*"
+
+// 本方的表授予协作方的 CCL 策略；未指定的协作方和列按模板，其次按 columns[].permissions
+type CCLPolicy struct {
+	Template string    `json:"template,omitempty"`
+	Rules    []CCLRule `json:"rules,omitempty"`
+}
+
+// 规则按匹配的精确程度生效：协作方和列都精确 > 协作方精确 > 列精确 > 都为通配符
+type CCLRule struct {
+	// 默认为本方的表，只能授权本方的表
+	Table      string `json:"table,omitempty"`
+	Party      string `json:"party"`
+	Column     string `json:"column"`
+	Constraint string `json:"constraint"`
+}
+
+// 一条列授权，Column 为请求中的列名
+type CCLGrant struct {
+	Party      string `json:"party"`
+	Table      string `json:"table"`
+	Column     string `json:"column"`
+	Constraint string `json:"constraint"`
+}
+
+func validateConstraint(constraint string) error {
+	if v, ok := pb.Constraint_value[constraint]; !ok || v == int32(pb.Constraint_UNKNOWN) {
+		return fmt.Errorf("not support constraint %v", constraint)
+	}
+	return nil
+}
+
+// 按策略、模板和列权限计算本方的表要授予的 CCL，同时校验策略；
+// 本方默认为 PLAINTEXT，没有任何规则的协作方和列不授权
+func (req *RunPrivacyRequest) cclGrants() ([]CCLGrant, error) {
+	type key struct{ party, column string }
+	type choice struct {
+		constraint string
+		rank       int
+		source     string
+	}
+	chosen := make(map[key]choice)
+	set := func(k key, c choice) error {
+		if old, ok := chosen[k]; ok && old.rank == c.rank && old.constraint != c.constraint {
+			return fmt.Errorf("ccl for %s on %s: %s conflicts with %s", k.party, k.column, c.source, old.source)
+		}
+		if old, ok := chosen[k]; !ok || c.rank > old.rank {
+			chosen[k] = c
+		}
+		return nil
+	}
+
+	columns := make([]string, len(req.Columns))
+	for i, column := range req.Columns {
+		columns[i] = column.Column
+	}
+	partners := make([]string, 0, len(req.partners()))
+	for _, p := range req.partners() {
+		partners = append(partners, p.User)
+	}
+
+	var policy CCLPolicy
+	if req.CCLPolicy != nil {
+		policy = *req.CCLPolicy
+	}
+	if policy.Template != "" {
+		tpl, ok := cclTemplates[policy.Template]
+		if !ok {
+			return nil, fmt.Errorf("ccl_policy: unknown template %s", policy.Template)
+		}
+		joinKeys := req.joinKeys()
+		for _, party := range partners {
+			for _, column := range columns {
+				constraint := tpl.Other
+				if slices.Contains(joinKeys, column) {
+					constraint = tpl.JoinKey
+				}
+				set(key{party, column}, choice{constraint, 0, "template " + policy.Template})
+			}
+		}
+	}
+
+	for i, rule := range policy.Rules {
+		source := fmt.Sprintf("ccl_policy.rules[%d]", i)
+		if rule.Table != "" && rule.Table != req.User {
+			return nil, fmt.Errorf("%s: only table %s can be granted", source, req.User)
+		}
+		if err := validateConstraint(rule.Constraint); err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		parties, cols := []string{rule.Party}, []string{rule.Column}
+		rank := 4
+		if rule.Party == cclWildcard {
+			parties = partners
+			rank -= 2
+		} else if !slices.Contains(partners, rule.Party) {
+			return nil, fmt.Errorf("%s: unknown party %s", source, rule.Party)
+		}
+		if rule.Column == cclWildcard {
+			cols = columns
+			rank--
+		} else if !slices.Contains(columns, rule.Column) {
+			return nil, fmt.Errorf("%s: unknown column %s", source, rule.Column)
+		}
+		for _, party := range parties {
+			for _, column := range cols {
+				if err := set(key{party, column}, choice{rule.Constraint, rank, source}); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// columns[].permissions 等同于协作方和列都精确的规则
+	for _, column := range req.Columns {
+		for _, per := range column.Permissions {
+			if err := validateConstraint(per.Permission); err != nil {
+				return nil, fmt.Errorf("column %s: %w", column.Column, err)
+			}
+			if err := set(key{per.User, column.Column}, choice{per.Permission, 4, "columns[].permissions"}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var grants []CCLGrant
+	for _, column := range columns {
+		owner := choice{constraint: "PLAINTEXT"}
+		if c, ok := chosen[key{req.User, column}]; ok {
+			owner = c
+		}
+		grants = append(grants, CCLGrant{Party: req.User, Table: req.User, Column: column, Constraint: owner.constraint})
+		for _, party := range partners {
+			if c, ok := chosen[key{party, column}]; ok {
+				grants = append(grants, CCLGrant{Party: party, Table: req.User, Column: column, Constraint: c.constraint})
+			}
+		}
+	}
+	return grants, nil
+}
+
+// 期望的 CCL 与 broker 中已有的 CCL 的差异，列名为表中的列名
+type CCLDiff struct {
+	Desired []CCLGrant `json:"desired"`
+	Current []CCLGrant `json:"current"`
+	// 未授予的
+	Missing []CCLGrant `json:"missing"`
+	// 约束不同的，Constraint 为期望值
+	Changed []CCLChange `json:"changed"`
+	// broker 中有而策略中没有的
+	Extra []CCLGrant `json:"extra"`
+}
+
+type CCLChange struct {
+	CCLGrant
+	Current string `json:"current"`
+}
+
+func diffCCL(desired, current []CCLGrant) *CCLDiff {
+	diff := &CCLDiff{Desired: desired, Current: current, Missing: []CCLGrant{}, Changed: []CCLChange{}, Extra: []CCLGrant{}}
+	key := func(g CCLGrant) string { return g.Party + "\x00" + g.Table + "\x00" + g.Column }
+	have := make(map[string]CCLGrant, len(current))
+	for _, g := range current {
+		have[key(g)] = g
+	}
+	want := make(map[string]bool, len(desired))
+	for _, g := range desired {
+		want[key(g)] = true
+		cur, ok := have[key(g)]
+		switch {
+		case !ok:
+			diff.Missing = append(diff.Missing, g)
+		case cur.Constraint != g.Constraint:
+			diff.Changed = append(diff.Changed, CCLChange{CCLGrant: g, Current: cur.Constraint})
+		}
+	}
+	for _, g := range current {
+		if !want[key(g)] {
+			diff.Extra = append(diff.Extra, g)
+		}
+	}
+	return diff
+}
+
+// broker 中表 tables 已授予的 CCL，tables 为空时返回项目中的全部
+func currentCCL(ctx context.Context, projectID string, tables ...string) ([]CCLGrant, error) {
+	resp, err := brokerCall(ctx, func() (*pb.ShowCCLResponse, error) {
+		return brokerCommand.GetCCL(projectID, tables, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	grants := []CCLGrant{}
+	for _, cc := range resp.GetColumnControlList() {
+		grants = append(grants, CCLGrant{
+			Party:      cc.GetPartyCode(),
+			Table:      cc.GetCol().GetTableName(),
+			Column:     cc.GetCol().GetColumnName(),
+			Constraint: cc.GetConstraint().String(),
+		})
+	}
+	return grants, nil
+}
+
+// 对比任务的 CCL 策略和 broker 中本方的表已授予的 CCL
+func getTaskCCLHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := taskStore.Get(r.PathValue("id"))
+	if err == ErrTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rec.Request == nil || rec.ProjectID == "" || rec.Dataset == nil {
+		http.Error(w, "table of task is not created", http.StatusConflict)
+		return
+	}
+	desired, err := rec.Request.cclGrants()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range desired {
+		if name := rec.Dataset.columnName(desired[i].Column); name != "" {
+			desired[i].Column = name
+		}
+	}
+	current, err := currentCCL(r.Context(), rec.ProjectID, rec.Request.User)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffCCL(desired, current))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCCLGrants(t *testing.T) {
+	// alice 的表 id, age, city，协作方 bob、carol
+	const base = `"user": "alice", "parties": [{"user": "bob"}, {"user": "carol"}],
+		"columns": [{"column": "id"}, {"column": "age"}, {"column": "city"}]`
+	tests := []struct {
+		name    string
+		request string
+		want    []string // party.column=constraint
+		wantErr string
+	}{
+		{
+			name:    "no policy grants only owner",
+			request: `{` + base + `}`,
+			want:    []string{"alice.id=PLAINTEXT", "alice.age=PLAINTEXT", "alice.city=PLAINTEXT"},
+		},
+		{
+			name:    "template with join keys",
+			request: `{` + base + `, "join_keys": ["id"], "ccl_policy": {"template": "join_keys"}}`,
+			want: []string{
+				"alice.id=PLAINTEXT", "bob.id=PLAINTEXT_AFTER_JOIN", "carol.id=PLAINTEXT_AFTER_JOIN",
+				"alice.age=PLAINTEXT", "bob.age=ENCRYPTED_ONLY", "carol.age=ENCRYPTED_ONLY",
+				"alice.city=PLAINTEXT", "bob.city=ENCRYPTED_ONLY", "carol.city=ENCRYPTED_ONLY",
+			},
+		},
+		{
+			name: "more specific rules win",
+			request: `{` + base + `, "ccl_policy": {"template": "encrypted_only", "rules": [
+				{"party": "*", "column": "*", "constraint": "PLAINTEXT_AFTER_COMPARE"},
+				{"party": "*", "column": "age", "constraint": "PLAINTEXT_AFTER_AGGREGATE"},
+				{"party": "bob", "column": "*", "constraint": "PLAINTEXT_AFTER_JOIN"},
+				{"party": "bob", "column": "city", "constraint": "ENCRYPTED_ONLY"}]}}`,
+			want: []string{
+				"alice.id=PLAINTEXT", "bob.id=PLAINTEXT_AFTER_JOIN", "carol.id=PLAINTEXT_AFTER_COMPARE",
+				"alice.age=PLAINTEXT", "bob.age=PLAINTEXT_AFTER_JOIN", "carol.age=PLAINTEXT_AFTER_AGGREGATE",
+				"alice.city=PLAINTEXT", "bob.city=ENCRYPTED_ONLY", "carol.city=PLAINTEXT_AFTER_COMPARE",
+			},
+		},
+		{
+			name: "column permissions merge with rules",
+			request: `{"user": "alice", "parties": [{"user": "bob"}],
+				"columns": [{"column": "id", "permissions": [{"user": "bob", "permission": "PLAINTEXT_AFTER_JOIN"}, {"user": "alice", "permission": "PLAINTEXT"}]}, {"column": "age"}],
+				"ccl_policy": {"rules": [{"party": "bob", "column": "*", "constraint": "ENCRYPTED_ONLY"}]}}`,
+			want: []string{"alice.id=PLAINTEXT", "bob.id=PLAINTEXT_AFTER_JOIN", "alice.age=PLAINTEXT", "bob.age=ENCRYPTED_ONLY"},
+		},
+		{
+			name: "conflicting exact rules",
+			request: `{` + base + `, "ccl_policy": {"rules": [
+				{"party": "bob", "column": "id", "constraint": "PLAINTEXT_AFTER_JOIN"},
+				{"party": "bob", "column": "id", "constraint": "ENCRYPTED_ONLY"}]}}`,
+			wantErr: "conflicts with",
+		},
+		{
+			name: "rule conflicts with column permission",
+			request: `{"user": "alice", "parties": [{"user": "bob"}],
+				"columns": [{"column": "id", "permissions": [{"user": "bob", "permission": "PLAINTEXT_AFTER_JOIN"}]}],
+				"ccl_policy": {"rules": [{"party": "bob", "column": "id", "constraint": "ENCRYPTED_ONLY"}]}}`,
+			wantErr: "conflicts with",
+		},
+		{
+			name:    "unknown template",
+			request: `{` + base + `, "ccl_policy": {"template": "open"}}`,
+			wantErr: "unknown template",
+		},
+		{
+			name:    "unknown party",
+			request: `{` + base + `, "ccl_policy": {"rules": [{"party": "dave", "column": "id", "constraint": "ENCRYPTED_ONLY"}]}}`,
+			wantErr: "unknown party dave",
+		},
+		{
+			name:    "unknown column",
+			request: `{` + base + `, "ccl_policy": {"rules": [{"party": "bob", "column": "name", "constraint": "ENCRYPTED_ONLY"}]}}`,
+			wantErr: "unknown column name",
+		},
+		{
+			name:    "other party's table",
+			request: `{` + base + `, "ccl_policy": {"rules": [{"table": "bob", "party": "bob", "column": "id", "constraint": "ENCRYPTED_ONLY"}]}}`,
+			wantErr: "only table alice",
+		},
+		{
+			name:    "unknown constraint",
+			request: `{` + base + `, "ccl_policy": {"rules": [{"party": "bob", "column": "id", "constraint": "UNKNOWN"}]}}`,
+			wantErr: "not support constraint",
+		},
+	}
+	for _, tt := range tests {
+		var req RunPrivacyRequest
+		if err := json.Unmarshal([]byte(tt.request), &req); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		grants, err := req.cclGrants()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, g := range grants {
+			if g.Table != "alice" {
+				t.Errorf("%s: grant on table %s", tt.name, g.Table)
+			}
+			got = append(got, g.Party+"."+g.Column+"="+g.Constraint)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCQL 列类型
+const (
+	DtypeInt64     = "int64"
+	DtypeFloat64   = "float64"
+	DtypeString    = "string"
+	DtypeDatetime  = "datetime"
+	DtypeTimestamp = "timestamp"
+)
+
+// 请求中可用的类型名，统一为 SCQL 类型
+var dtypeAliases = map[string]string{
+	"int":       DtypeInt64,
+	"int32":     DtypeInt64,
+	"int64":     DtypeInt64,
+	"integer":   DtypeInt64,
+	"long":      DtypeInt64,
+	"float":     DtypeFloat64,
+	"float32":   DtypeFloat64,
+	"float64":   DtypeFloat64,
+	"double":    DtypeFloat64,
+	"string":    DtypeString,
+	"str":       DtypeString,
+	"datetime":  DtypeDatetime,
+	"timestamp": DtypeTimestamp,
+}
+
+// SCQL 类型对应的 MySQL 列类型
+var mysqlTypes = map[string]string{
+	DtypeInt64:     "BIGINT",
+	DtypeFloat64:   "DOUBLE",
+	DtypeString:    "VARCHAR(512)",
+	DtypeDatetime:  "DATETIME",
+	DtypeTimestamp: "TIMESTAMP NULL DEFAULT NULL",
+}
+
+// 可识别的时间格式，导入时统一为 MySQL 格式
+var datetimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+	"2006-01-02 15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+}
+
+const mysqlDatetimeLayout = "2006-01-02 15:04:05"
+
+// 类型推断最多读取的行数
+const inferSampleRows = 1000
+
+// 任务记录中最多保留的行错误数
+const maxRowErrors = 100
+
+func normalizeDtype(dtype string) (string, bool) {
+	t, ok := dtypeAliases[strings.ToLower(strings.TrimSpace(dtype))]
+	return t, ok
+}
+
+// 列的类型，Column 为导入 MySQL 和 SCQL 使用的安全列名，Source 为 CSV 表头中的原始列名；
+// Inferred 表示类型由数据推断
+type ColumnSchema struct {
+	Column    string `json:"column"`
+	Source    string `json:"source,omitempty"`
+	Type      string `json:"type"`
+	MySQLType string `json:"mysql_type"`
+	Inferred  bool   `json:"inferred,omitempty"`
+}
+
+// 无法按列类型解析的行
+type RowError struct {
+	Line   int    `json:"line"`
+	Column string `json:"column,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Error  string `json:"error"`
+}
+
+// 数据导入结果
+type DatasetReport struct {
+	Columns      []ColumnSchema `json:"columns"`
+	Rows         int64          `json:"rows"`
+	RejectedRows int64          `json:"rejected_rows"`
+	// 最多保留 maxRowErrors 条
+	RowErrors []RowError `json:"row_errors,omitempty"`
+	// 导入后的数据集概况
+	Profile *DatasetProfile `json:"profile,omitempty"`
+
+	// 各列无法解析的行数
+	parseErrors map[string]int64
+}
+
+// 列名到 SCQL 类型
+func (r *DatasetReport) columnTypes() map[string]string {
+	types := make(map[string]string)
+	if r == nil {
+		return types
+	}
+	for _, c := range r.Columns {
+		types[c.Column] = c.Type
+	}
+	return types
+}
+
+// 请求中的列名（原始列名或安全列名）对应的安全列名，未导入的列返回空
+func (r *DatasetReport) columnName(name string) string {
+	if r == nil {
+		return ""
+	}
+	for _, c := range r.Columns {
+		if c.Source == name || c.Column == name {
+			return c.Column
+		}
+	}
+	return ""
+}
+
+func (r *DatasetReport) addRowError(e RowError) {
+	if e.Column != "" {
+		if r.parseErrors == nil {
+			r.parseErrors = make(map[string]int64)
+		}
+		r.parseErrors[e.Column]++
+	}
+	if len(r.RowErrors) < maxRowErrors {
+		r.RowErrors = append(r.RowErrors, e)
+	}
+}
+
+// 按类型解析 value，返回写入导入文件的值，空值返回 nil（NULL）
+func parseValue(dtype, value string) (*string, error) {
+	if value == "" {
+		if dtype == DtypeString {
+			return &value, nil
+		}
+		return nil, nil
+	}
+	switch dtype {
+	case DtypeInt64:
+		if _, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err != nil {
+			return nil, fmt.Errorf("not an int64")
+		}
+		value = strings.TrimSpace(value)
+	case DtypeFloat64:
+		if _, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil {
+			return nil, fmt.Errorf("not a float64")
+		}
+		value = strings.TrimSpace(value)
+	case DtypeDatetime, DtypeTimestamp:
+		t, err := parseDatetime(value)
+		if err != nil && dtype == DtypeTimestamp {
+			// timestamp 也可以是 unix 秒
+			if sec, serr := strconv.ParseInt(strings.TrimSpace(value), 10, 64); serr == nil {
+				t, err = time.Unix(sec, 0).UTC(), nil
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("not a %s", dtype)
+		}
+		value = t.Format(mysqlDatetimeLayout)
+	}
+	return &value, nil
+}
+
+func parseDatetime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range datetimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("unknown datetime format")
+}
+
+// 根据样本推断类型：int64 > float64 > datetime > string
+func inferDtype(values []string) string {
+	candidates := []string{DtypeInt64, DtypeFloat64, DtypeDatetime}
+	seen := false
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		seen = true
+		var next []string
+		for _, dtype := range candidates {
+			if _, err := parseValue(dtype, v); err == nil {
+				next = append(next, dtype)
+			}
+		}
+		candidates = next
+		if len(candidates) == 0 {
+			break
+		}
+	}
+	if !seen || len(candidates) == 0 {
+		return DtypeString
+	}
+	return candidates[0]
+}
+
+// 确定各列类型：请求中声明的类型优先，未声明的列在 infer 时由前 inferSampleRows 行推断，否则为 string
+func datasetSchema(reader DatasetReader, req *RunPrivacyRequest) ([]ColumnSchema, error) {
+	declared := make(map[string]string)
+	for _, column := range req.Columns {
+		if column.Type == "" {
+			continue
+		}
+		dtype, ok := normalizeDtype(column.Type)
+		if !ok {
+			return nil, fmt.Errorf("column %s: unknown type %s", column.Column, column.Type)
+		}
+		declared[column.Column] = dtype
+	}
+
+	header := reader.Header()
+	var samples [][]string
+	if req.InferTypes {
+		var err error
+		samples, err = sampleColumns(reader, len(header))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := safeColumnNames(header)
+	schema := make([]ColumnSchema, len(header))
+	for i, source := range header {
+		col := ColumnSchema{Column: names[i], Type: declared[source]}
+		if col.Type == "" {
+			col.Type = declared[names[i]]
+		}
+		if source != names[i] {
+			col.Source = source
+		}
+		if col.Type == "" {
+			col.Type = DtypeString
+			if req.InferTypes {
+				col.Type = inferDtype(samples[i])
+				col.Inferred = true
+			}
+		}
+		col.MySQLType = mysqlTypes[col.Type]
+		schema[i] = col
+	}
+
+	// 请求中的列和关联键必须出现在表头中，在导入前失败
+	known := make(map[string]bool)
+	for i, source := range header {
+		known[source] = true
+		known[names[i]] = true
+	}
+	var missing []string
+	for _, column := range req.Columns {
+		if !known[column.Column] && !slices.Contains(missing, column.Column) {
+			missing = append(missing, column.Column)
+		}
+	}
+	for _, key := range req.JoinKeys {
+		if !known[key] && !slices.Contains(missing, key) {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("columns not found in header: %s", strings.Join(missing, ", "))
+	}
+	return schema, nil
+}
+
+// 读取前 inferSampleRows 行，按列返回
+func sampleColumns(reader DatasetReader, n int) ([][]string, error) {
+	samples := make([][]string, n)
+	for rows := 0; rows < inferSampleRows; rows++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var perr *RowParseError
+		if errors.As(err, &perr) {
+			// 格式错误的行在导入时报告
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < n && i < len(record); i++ {
+			if record[i] != nil {
+				samples[i] = append(samples[i], *record[i])
+			}
+		}
+	}
+	return samples, nil
+}
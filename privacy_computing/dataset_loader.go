@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// 每导入多少行报告一次进度
+const progressRows = 100000
+
+// 批量 INSERT 每条语句的最多行数，同时受 MySQL 占位符数量（65535）限制
+const insertBatchRows = 1000
+
+// LOAD DATA 被禁止时 MySQL 返回的错误：secure_file_priv、local_infile、缺少 FILE 权限
+var loadDataDeniedErrors = map[uint16]bool{
+	1045: true,
+	1148: true,
+	1227: true,
+	1290: true,
+	3948: true,
+}
+
+// 导入方式，环境变量 DATASET_LOAD_MODE：load（默认，LOAD DATA，不允许时退回 insert）/ insert（批量 INSERT）
+func datasetLoadMode() string {
+	if os.Getenv("DATASET_LOAD_MODE") == "insert" {
+		return "insert"
+	}
+	return "load"
+}
+
+// 逐行读取数据集并按 schema 解析，合法的行交给 emit（nil 为 NULL），不合法的行记入 report；
+// 每 progressRows 行以已处理的行数调用 progress，并检查 ctx 是否已结束
+func scanDataset(ctx context.Context, reader DatasetReader, schema []ColumnSchema, report *DatasetReport, emit func(row []*string) error, progress func(rows int64)) error {
+	row := make([]*string, len(schema))
+	var scanned int64
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		scanned++
+		if scanned%progressRows == 0 {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			progress(scanned)
+		}
+		var perr *RowParseError
+		if errors.As(err, &perr) {
+			report.RejectedRows++
+			report.addRowError(RowError{Line: perr.Line, Error: perr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		lineNo := reader.Line()
+		if len(record) != len(schema) {
+			report.RejectedRows++
+			report.addRowError(RowError{Line: lineNo, Error: fmt.Sprintf("expected %d fields, got %d", len(schema), len(record))})
+			continue
+		}
+
+		rejected := false
+		for i, col := range schema {
+			if record[i] == nil {
+				row[i] = nil
+				continue
+			}
+			v, err := parseValue(col.Type, *record[i])
+			if err != nil {
+				report.RejectedRows++
+				report.addRowError(RowError{Line: lineNo, Column: col.Column, Value: *record[i], Error: err.Error()})
+				rejected = true
+				break
+			}
+			row[i] = v
+		}
+		if rejected {
+			continue
+		}
+		if err := emit(row); err != nil {
+			return err
+		}
+		report.Rows++
+	}
+	progress(scanned)
+	return nil
+}
+
+// LOAD DATA 使用的文件：非空值都加引号，未加引号的 NULL 由 LOAD DATA 读为 NULL
+type loadFileWriter struct {
+	w *bufio.Writer
+}
+
+func (l *loadFileWriter) write(row []*string) error {
+	for i, v := range row {
+		if i > 0 {
+			l.w.WriteByte(',')
+		}
+		if v == nil {
+			l.w.WriteString("NULL")
+		} else {
+			l.w.WriteString(`"` + strings.ReplaceAll(*v, `"`, `""`) + `"`)
+		}
+	}
+	return l.w.WriteByte('\n')
+}
+
+// 批量 INSERT，缓存的行数达到 batch 时写入
+type batchInserter struct {
+	ctx    context.Context
+	db     *sql.DB
+	prefix string
+	batch  int
+	args   []any
+	rows   int
+}
+
+func newBatchInserter(ctx context.Context, db *sql.DB, table string, columns []string) *batchInserter {
+	return &batchInserter{
+		ctx:    ctx,
+		db:     db,
+		prefix: fmt.Sprintf("INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ",")),
+		batch:  max(1, min(insertBatchRows, 65535/len(columns))),
+	}
+}
+
+func (b *batchInserter) write(row []*string) error {
+	for _, v := range row {
+		if v == nil {
+			b.args = append(b.args, nil)
+		} else {
+			b.args = append(b.args, *v)
+		}
+	}
+	b.rows++
+	if b.rows >= b.batch {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *batchInserter) flush() error {
+	if b.rows == 0 {
+		return nil
+	}
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?,", len(b.args)/b.rows), ",") + ")"
+	values := strings.TrimSuffix(strings.Repeat(placeholder+",", b.rows), ",")
+	err := ExecSQLContext(b.ctx, b.db, b.prefix+values, b.args...)
+	b.args = b.args[:0]
+	b.rows = 0
+	return err
+}
+
+func isLoadDataDenied(err error) bool {
+	var merr *mysql.MySQLError
+	return errors.As(err, &merr) && loadDataDeniedErrors[merr.Number]
+}
+
+// 导入的各步骤，分别报告进度：validate 校验并生成导入文件，load 为 LOAD DATA 导入的行数，insert 为批量 INSERT 已处理的行数
+const (
+	loadStageValidate = "validate"
+	loadStageLoad     = "load"
+	loadStageInsert   = "insert"
+)
+
+// 把数据集 dataFile（csv / tsv / jsonl / parquet）导入 MySQL 表 engine.table；被拒绝的行超过 req.MaxRejectedRows 时返回错误，report 中带有行错误。
+// 数据逐行流式处理，progress 报告当前步骤和该步骤已处理的行数
+func checkDataset(ctx context.Context, dataFile, table string, req *RunPrivacyRequest, progress func(stage string, rows int64)) (*DatasetReport, error) {
+	db, err := GetDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	open := func() (DatasetReader, error) {
+		return openDataset(dataFile, req.Data, req.DataFormat)
+	}
+	reader, err := open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dataset: %w", err)
+	}
+	schema, err := datasetSchema(reader, req)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	report := &DatasetReport{Columns: schema}
+
+	quotedTable, err := quoteIdent(table)
+	if err != nil {
+		return report, err
+	}
+	columns := make([]string, len(schema))
+	for i, column := range schema {
+		if columns[i], err = quoteIdent(column.Column); err != nil {
+			return report, err
+		}
+	}
+
+	// 先校验并生成导入文件，被拒绝的行过多时不改动数据库
+	mode := datasetLoadMode()
+	loadFile := filepath.Join(filepath.Dir(dataFile), "load.csv")
+	validated := func(rows int64) { progress(loadStageValidate, rows) }
+	if mode == "load" {
+		defer os.Remove(loadFile)
+		err = writeLoadFile(ctx, open, loadFile, schema, report, validated)
+	} else {
+		err = scanWith(ctx, open, schema, report, func([]*string) error { return nil }, validated)
+	}
+	if err != nil {
+		return report, err
+	}
+	if report.RejectedRows > int64(req.MaxRejectedRows) {
+		return report, fmt.Errorf("%d rows rejected, max_rejected_rows is %d", report.RejectedRows, req.MaxRejectedRows)
+	}
+
+	err = ExecSQLContext(ctx, db, fmt.Sprintf("drop table IF EXISTS %s", quotedTable))
+	if err != nil {
+		return report, err
+	}
+	create_table_sql := fmt.Sprintf("CREATE TABLE %s (", quotedTable)
+	for n, column := range schema {
+		if n > 0 {
+			create_table_sql += ","
+		}
+		create_table_sql += fmt.Sprintf("%s %s", columns[n], column.MySQLType)
+	}
+	create_table_sql += ") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;"
+
+	err = ExecSQLContext(ctx, db, create_table_sql)
+	if err != nil {
+		return report, err
+	}
+
+	if mode == "load" {
+		quotedFile, err := quoteLiteral(loadFile)
+		if err != nil {
+			return report, fmt.Errorf("load file: %w", err)
+		}
+		load_data_sql := fmt.Sprintf(`
+		LOAD DATA INFILE %s INTO TABLE %s
+		FIELDS TERMINATED BY ','
+		ENCLOSED BY '"'
+		ESCAPED BY ''
+		LINES TERMINATED BY '\n'
+		(%s)`, quotedFile, quotedTable, strings.Join(columns, ","))
+
+		err = ExecSQLContext(ctx, db, load_data_sql)
+		if err == nil {
+			progress(loadStageLoad, report.Rows)
+		}
+		if err == nil || !isLoadDataDenied(err) {
+			return report, err
+		}
+		log.Warnf("LOAD DATA not allowed, fall back to batched INSERT: %v", err)
+	}
+
+	// 导入文件已校验过，重新扫描时的行错误与 report 相同；进度从 0 重新计数
+	progress(loadStageInsert, 0)
+	inserter := newBatchInserter(ctx, db, quotedTable, columns)
+	err = scanWith(ctx, open, schema, &DatasetReport{}, inserter.write, func(rows int64) { progress(loadStageInsert, rows) })
+	if err != nil {
+		return report, err
+	}
+	return report, inserter.flush()
+}
+
+// 打开数据集并逐行扫描
+func scanWith(ctx context.Context, open func() (DatasetReader, error), schema []ColumnSchema, report *DatasetReport, emit func(row []*string) error, progress func(rows int64)) error {
+	reader, err := open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return scanDataset(ctx, reader, schema, report, emit, progress)
+}
+
+// 校验数据集并生成 LOAD DATA 使用的文件
+func writeLoadFile(ctx context.Context, open func() (DatasetReader, error), loadFile string, schema []ColumnSchema, report *DatasetReport, progress func(rows int64)) error {
+	out, err := os.Create(loadFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := &loadFileWriter{w: bufio.NewWriter(out)}
+	if err := scanWith(ctx, open, schema, report, w.write, progress); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// 无限行的数据集
+type endlessReader struct{ line int }
+
+func (r *endlessReader) Header() []string { return []string{"a"} }
+func (r *endlessReader) Line() int        { return r.line }
+func (r *endlessReader) Close() error     { return nil }
+func (r *endlessReader) Read() ([]*string, error) {
+	r.line++
+	v := "x"
+	return []*string{&v}, nil
+}
+
+func TestScanDatasetCancel(t *testing.T) {
+	cause := errors.New("task cancelled")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	schema := []ColumnSchema{{Column: "a", Type: DtypeString}}
+	report := &DatasetReport{}
+	var progressed []int64
+	err := scanDataset(ctx, &endlessReader{}, schema, report, func(row []*string) error {
+		if report.Rows == progressRows {
+			cancel(cause)
+		}
+		return nil
+	}, func(rows int64) { progressed = append(progressed, rows) })
+	if !errors.Is(err, cause) {
+		t.Fatalf("err = %v, want %v", err, cause)
+	}
+	// 在下一个 progressRows 边界停止
+	if report.Rows != 2*progressRows-1 || len(progressed) != 1 || progressed[0] != progressRows {
+		t.Errorf("rows = %d, progress = %v", report.Rows, progressed)
+	}
+}
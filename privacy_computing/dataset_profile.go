@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 导入后的数据集概况，只保存在本地任务记录中，不发送给协作方
+type DatasetProfile struct {
+	Rows     int64            `json:"rows"`
+	Columns  []ColumnProfile  `json:"columns"`
+	JoinKeys []JoinKeyProfile `json:"join_keys,omitempty"`
+}
+
+type ColumnProfile struct {
+	Column   string  `json:"column"`
+	Type     string  `json:"type"`
+	Nulls    int64   `json:"nulls"`
+	NullRate float64 `json:"null_rate"`
+	// 不同值的个数（不含 NULL），由前 profileSampleRows 行估计
+	Distinct int64 `json:"distinct"`
+	// 因无法按类型解析被拒绝的行数
+	ParseErrors int64 `json:"parse_errors"`
+}
+
+// 关联键的重复情况，重复的键在 JOIN 后会放大结果行数
+type JoinKeyProfile struct {
+	Column string `json:"column"`
+	// 出现多于一次的键值个数
+	DuplicateKeys int64 `json:"duplicate_keys"`
+	// 重复键值所在的行数
+	DuplicateRows int64 `json:"duplicate_rows"`
+}
+
+// 需要检查重复值的关联键：请求指定的 join_keys，否则为有 PLAINTEXT_AFTER_JOIN 权限的列
+func (req *RunPrivacyRequest) joinKeys() []string {
+	if len(req.JoinKeys) > 0 {
+		return req.JoinKeys
+	}
+	var keys []string
+	for _, column := range req.Columns {
+		for _, per := range column.Permissions {
+			if per.Permission == "PLAINTEXT_AFTER_JOIN" {
+				keys = append(keys, column.Column)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// 估计不同值个数时抽样的行数：取表的前若干行，避免对整表 COUNT(DISTINCT)
+const profileSampleRows = 100000
+
+// 统计已导入的 engine.table：行数、各列空值率和不同值个数的估计、解析失败的行数、关联键的重复值
+func profileDataset(ctx context.Context, table string, report *DatasetReport, req *RunPrivacyRequest) (*DatasetProfile, error) {
+	db, err := GetDB(dsn)
+	if err != nil {
+		return nil, err
+	}
+	name, err := quoteTable("engine", table)
+	if err != nil {
+		return nil, err
+	}
+
+	// 行数和各列非空值个数在一次扫描中统计
+	cols := make([]string, len(report.Columns))
+	exprs := []string{"COUNT(*) AS n"}
+	for i, column := range report.Columns {
+		if cols[i], err = quoteIdent(column.Column); err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, fmt.Sprintf("COUNT(%s) AS n%d", cols[i], i))
+	}
+	rows, err := GetTableRowsContext(ctx, db, fmt.Sprintf("SELECT %s FROM %s", strings.Join(exprs, ", "), name))
+	if err != nil {
+		return nil, fmt.Errorf("profile columns: %w", err)
+	}
+	var stats map[string]any
+	if len(rows) > 0 {
+		stats = rows[0]
+	}
+
+	profile := &DatasetProfile{Rows: toInt64(stats["n"])}
+	for i, column := range report.Columns {
+		nonNull := toInt64(stats[fmt.Sprintf("n%d", i)])
+		p := ColumnProfile{
+			Column:      column.Column,
+			Type:        column.Type,
+			Nulls:       profile.Rows - nonNull,
+			ParseErrors: report.parseErrors[column.Column],
+		}
+		if profile.Rows > 0 {
+			p.NullRate = float64(p.Nulls) / float64(profile.Rows)
+		}
+		if nonNull > 0 {
+			// 样本中每个值的出现次数：d 为不同值个数，f1 为只出现一次的值的个数，sampled 为非空值个数
+			rows, err := GetTableRowsContext(ctx, db, fmt.Sprintf(
+				"SELECT COUNT(*) AS d, COALESCE(SUM(c = 1), 0) AS f1, COALESCE(SUM(c), 0) AS sampled FROM (SELECT COUNT(*) AS c FROM (SELECT %s AS v FROM %s LIMIT %d) s WHERE v IS NOT NULL GROUP BY v) g",
+				cols[i], name, profileSampleRows))
+			if err != nil {
+				return nil, fmt.Errorf("profile column %s: %w", column.Column, err)
+			}
+			if len(rows) > 0 {
+				r := rows[0]
+				p.Distinct = estimateDistinct(toInt64(r["d"]), toInt64(r["f1"]), toInt64(r["sampled"]), nonNull)
+			}
+		}
+		profile.Columns = append(profile.Columns, p)
+	}
+
+	for _, key := range req.joinKeys() {
+		column := report.columnName(key)
+		if column == "" {
+			continue
+		}
+		col, err := quoteIdent(column)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := GetTableRowsContext(ctx, db, fmt.Sprintf(
+			"SELECT COUNT(*) AS dup_keys, COALESCE(SUM(c), 0) AS dup_rows FROM (SELECT COUNT(*) AS c FROM %s WHERE %s IS NOT NULL GROUP BY %s HAVING COUNT(*) > 1) d",
+			name, col, col))
+		if err != nil {
+			return nil, fmt.Errorf("profile join key %s: %w", column, err)
+		}
+		jp := JoinKeyProfile{Column: column}
+		if len(rows) > 0 {
+			jp.DuplicateKeys = toInt64(rows[0]["dup_keys"])
+			jp.DuplicateRows = toInt64(rows[0]["dup_rows"])
+		}
+		if jp.DuplicateKeys > 0 {
+			log.Warnf("join key %s of %s has %d duplicate values in %d rows", column, table, jp.DuplicateKeys, jp.DuplicateRows)
+		}
+		profile.JoinKeys = append(profile.JoinKeys, jp)
+	}
+	return profile, nil
+}
+
+// 由样本估计不同值个数（GEE 估计）：样本中只出现一次的值按 sqrt(total/sampled) 放大，
+// 出现多次的值视为在全表中也只有这些；样本覆盖全部非空值时为精确值
+func estimateDistinct(distinct, singletons, sampled, total int64) int64 {
+	if sampled <= 0 || sampled >= total {
+		return distinct
+	}
+	est := int64(math.Round(math.Sqrt(float64(total)/float64(sampled))*float64(singletons))) + distinct - singletons
+	return min(max(est, distinct), total)
+}
+
+// GetTableRows 返回的数值：文本协议下为 []byte
+func toInt64(v any) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case []byte:
+		i, _ := strconv.ParseInt(string(n), 10, 64)
+		return i
+	case string:
+		i, _ := strconv.ParseInt(n, 10, 64)
+		return i
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+	"github.com/apache/arrow/go/v17/parquet/file"
+	"github.com/apache/arrow/go/v17/parquet/pqarrow"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// 数据集格式
+const (
+	FormatAuto    = "auto"
+	FormatCSV     = "csv"
+	FormatTSV     = "tsv"
+	FormatJSON    = "json"
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+)
+
+// 数据集的格式和解析参数，未设置的字段按文件扩展名和内容识别
+type DataFormat struct {
+	// auto（默认）/ csv / tsv / json / jsonl / parquet
+	Format string `json:"format,omitempty"`
+	// csv 分隔符，默认按表头识别 , ; | 或制表符
+	Delimiter string `json:"delimiter,omitempty"`
+	// csv 引号，默认 "，none 表示不使用引号
+	Quote string `json:"quote,omitempty"`
+	// 文本编码：utf-8（默认）/ gbk / gb18030 / utf-16
+	Encoding string `json:"encoding,omitempty"`
+	// 换行符：auto（默认，\n、\r\n 或 \r）/ lf / crlf / cr
+	LineEnding string `json:"line_ending,omitempty"`
+}
+
+var textEncodings = map[string]encoding.Encoding{
+	"utf-8":   unicode.UTF8,
+	"utf8":    unicode.UTF8,
+	"gbk":     simplifiedchinese.GBK,
+	"gb18030": simplifiedchinese.GB18030,
+	"utf-16":  unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+}
+
+var lineEndings = map[string]bool{"auto": true, "lf": true, "crlf": true, "cr": true}
+
+// 可以自动识别的 csv 分隔符
+var sniffDelimiters = []rune{',', ';', '\t', '|'}
+
+// 文件扩展名对应的格式
+var formatExtensions = map[string]string{
+	".csv":     FormatCSV,
+	".txt":     FormatCSV,
+	".tsv":     FormatTSV,
+	".jsonl":   FormatJSONL,
+	".ndjson":  FormatJSONL,
+	".json":    FormatJSON,
+	".parquet": FormatParquet,
+	".pq":      FormatParquet,
+}
+
+func (f *DataFormat) Validate() error {
+	if f == nil {
+		return nil
+	}
+	switch strings.ToLower(f.Format) {
+	case "", FormatAuto, FormatCSV, FormatTSV, FormatJSON, FormatJSONL, FormatParquet:
+	default:
+		return fmt.Errorf("not support data format %v", f.Format)
+	}
+	if f.Delimiter != "" && utf8.RuneCountInString(f.Delimiter) != 1 && f.Delimiter != `\t` {
+		return fmt.Errorf("delimiter must be a single character")
+	}
+	if f.Quote != "" && f.Quote != "none" && utf8.RuneCountInString(f.Quote) != 1 {
+		return fmt.Errorf("quote must be a single character or none")
+	}
+	if _, ok := textEncodings[strings.ToLower(f.Encoding)]; f.Encoding != "" && !ok {
+		return fmt.Errorf("not support encoding %v", f.Encoding)
+	}
+	if f.LineEnding != "" && !lineEndings[strings.ToLower(f.LineEnding)] {
+		return fmt.Errorf("not support line ending %v", f.LineEnding)
+	}
+	return nil
+}
+
+// 单行格式错误，读取器可以继续读取下一行
+type RowParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *RowParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// 数据集读取器：统一的表头和逐行记录，nil 为 NULL（JSON 的 null 和缺少的键、parquet 的 null），
+// CSV 的空字段为空字符串
+type DatasetReader interface {
+	Header() []string
+	// 读取下一行，结束时返回 io.EOF；单行格式错误返回 *RowParseError
+	Read() ([]*string, error)
+	// 最近一次读取的行的行号（json 数组和 parquet 为行序号）
+	Line() int
+	Close() error
+}
+
+// 识别数据集格式：请求指定的格式优先，其次是扩展名（name 为 Nexus 中的路径），最后按内容识别
+func detectFormat(path, name string, df *DataFormat) (string, error) {
+	if df != nil && df.Format != "" && strings.ToLower(df.Format) != FormatAuto {
+		return strings.ToLower(df.Format), nil
+	}
+	if format, ok := formatExtensions[strings.ToLower(filepath.Ext(name))]; ok {
+		return format, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("PAR1")):
+		return FormatParquet, nil
+	}
+	switch trimmed := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n"); {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return FormatJSONL, nil
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		return FormatJSON, nil
+	}
+	return FormatCSV, nil
+}
+
+// 打开数据集，name 为 Nexus 中的路径，用于按扩展名识别格式
+func openDataset(path, name string, df *DataFormat) (DatasetReader, error) {
+	format, err := detectFormat(path, name, df)
+	if err != nil {
+		return nil, err
+	}
+	if df == nil {
+		df = &DataFormat{}
+	}
+	if format == FormatParquet {
+		return newParquetReader(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	enc, ok := textEncodings[strings.ToLower(df.Encoding)]
+	if !ok {
+		enc = unicode.UTF8
+	}
+	// 去掉 BOM，并按 BOM 识别 UTF-8 / UTF-16
+	r := bufio.NewReader(transform.NewReader(f, unicode.BOMOverride(enc.NewDecoder())))
+
+	var reader DatasetReader
+	switch format {
+	case FormatJSONL:
+		reader, err = newJSONLReader(r, f)
+	case FormatJSON:
+		reader, err = newJSONArrayReader(r, f)
+	case FormatCSV, FormatTSV:
+		reader, err = newDelimitedReader(r, f, format, df)
+	default:
+		err = fmt.Errorf("not support data format %v", format)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// 单个字段和单行记录的大小上限（字节），超过时该行作为格式错误拒绝，
+// 避免引号不匹配时把文件剩余部分读入同一个字段
+var (
+	maxFieldBytes  = 1 << 20
+	maxRecordBytes = 8 << 20
+)
+
+// ================================
+// csv / tsv
+// ================================
+type delimitedReader struct {
+	r          *bufio.Reader
+	closer     io.Closer
+	comma      rune
+	quote      rune // 0 表示不使用引号
+	lineEnding string
+	header     []string
+	line       int // 最近一行的起始行号
+	nextLine   int
+}
+
+func newDelimitedReader(r *bufio.Reader, closer io.Closer, format string, df *DataFormat) (*delimitedReader, error) {
+	d := &delimitedReader{r: r, closer: closer, quote: '"', lineEnding: strings.ToLower(df.LineEnding), nextLine: 1}
+	if d.lineEnding == "" {
+		d.lineEnding = "auto"
+	}
+	switch {
+	case df.Quote == "none":
+		d.quote = 0
+	case df.Quote != "":
+		d.quote, _ = utf8.DecodeRuneInString(df.Quote)
+	}
+	switch {
+	case df.Delimiter == `\t`:
+		d.comma = '\t'
+	case df.Delimiter != "":
+		d.comma, _ = utf8.DecodeRuneInString(df.Delimiter)
+	case format == FormatTSV:
+		d.comma = '\t'
+	default:
+		d.comma = d.sniffDelimiter()
+	}
+
+	header, err := d.Read()
+	if err == io.EOF {
+		return nil, errors.New("empty dataset")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	for _, name := range header {
+		d.header = append(d.header, *name)
+	}
+	return d, nil
+}
+
+// 按表头中出现最多的字符识别分隔符，默认为逗号
+func (d *delimitedReader) sniffDelimiter() rune {
+	head, _ := d.r.Peek(4096)
+	if i := bytes.IndexAny(head, "\r\n"); i >= 0 {
+		head = head[:i]
+	}
+	best, count := ',', 0
+	for _, c := range sniffDelimiters {
+		if n := strings.Count(string(head), string(c)); n > count {
+			best, count = c, n
+		}
+	}
+	return best
+}
+
+func (d *delimitedReader) Header() []string { return d.header }
+func (d *delimitedReader) Line() int        { return d.line }
+func (d *delimitedReader) Close() error     { return d.closer.Close() }
+
+// 读取到的字符是否为换行，是则消费完整的换行符
+func (d *delimitedReader) isLineEnd(c rune) bool {
+	switch c {
+	case '\n':
+		return d.lineEnding == "auto" || d.lineEnding == "lf"
+	case '\r':
+		switch d.lineEnding {
+		case "cr":
+			return true
+		case "auto", "crlf":
+			if next, _, err := d.r.ReadRune(); err == nil {
+				if next == '\n' {
+					return true
+				}
+				d.r.UnreadRune()
+			}
+			return d.lineEnding == "auto"
+		}
+	}
+	return false
+}
+
+func (d *delimitedReader) Read() ([]*string, error) {
+	for {
+		record, empty, err := d.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			values := make([]*string, len(record))
+			for i := range record {
+				values[i] = &record[i]
+			}
+			return values, nil
+		}
+		// 跳过空行
+	}
+}
+
+func (d *delimitedReader) readRecord() ([]string, bool, error) {
+	d.line = d.nextLine
+	var (
+		record  []string
+		field   strings.Builder
+		size    int // record 中已有字段的字节数
+		inQuote bool
+		quoted  bool
+		read    bool
+	)
+	for {
+		if field.Len() > maxFieldBytes {
+			return d.skipRecord(fmt.Errorf("field exceeds %d bytes", maxFieldBytes))
+		}
+		if size+field.Len() > maxRecordBytes {
+			return d.skipRecord(fmt.Errorf("record exceeds %d bytes", maxRecordBytes))
+		}
+		c, _, err := d.r.ReadRune()
+		if err == io.EOF {
+			if !read {
+				return nil, false, io.EOF
+			}
+			if inQuote {
+				return nil, false, &RowParseError{Line: d.line, Err: errors.New("unterminated quoted field")}
+			}
+			return append(record, field.String()), false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		read = true
+
+		if inQuote {
+			switch {
+			case c == d.quote:
+				if next, _, err := d.r.ReadRune(); err == nil {
+					if next == d.quote {
+						field.WriteRune(c)
+						continue
+					}
+					d.r.UnreadRune()
+				}
+				inQuote = false
+			case c == '\n' || c == '\r':
+				if c == '\n' || d.lineEnding == "cr" {
+					d.nextLine++
+				}
+				field.WriteRune(c)
+			default:
+				field.WriteRune(c)
+			}
+			continue
+		}
+
+		switch {
+		case d.quote != 0 && c == d.quote && field.Len() == 0 && !quoted:
+			inQuote, quoted = true, true
+		case c == d.comma:
+			record = append(record, field.String())
+			size += field.Len()
+			field.Reset()
+			quoted = false
+		case d.isLineEnd(c):
+			d.nextLine++
+			record = append(record, field.String())
+			empty := len(record) == 1 && record[0] == "" && !quoted
+			return record, empty, nil
+		default:
+			field.WriteRune(c)
+		}
+	}
+}
+
+// 字段或记录超过上限时丢弃到下一个换行为止（不再识别引号），返回该行的格式错误
+func (d *delimitedReader) skipRecord(err error) ([]string, bool, error) {
+	for {
+		c, _, rerr := d.r.ReadRune()
+		if rerr != nil {
+			break
+		}
+		if d.isLineEnd(c) {
+			d.nextLine++
+			break
+		}
+	}
+	return nil, false, &RowParseError{Line: d.line, Err: err}
+}
+
+// ================================
+// JSON Lines（每行一个对象）/ JSON 数组：第一个对象的字段顺序作为表头
+// ================================
+type jsonlReader struct {
+	// 读取下一个对象的 JSON 文本，结束时返回 io.EOF
+	next   func() ([]byte, error)
+	closer io.Closer
+	header []string
+	index  map[string]int
+	line   int
+	first  []*string
+}
+
+func newJSONLReader(r *bufio.Reader, closer io.Closer) (*jsonlReader, error) {
+	j := &jsonlReader{closer: closer, index: make(map[string]int)}
+	j.next = func() ([]byte, error) {
+		return j.readLine(r)
+	}
+	return j, j.readHeader()
+}
+
+// JSON 数组逐个元素解码，不整体读入内存；数组本身格式错误时无法继续读取，返回错误
+func newJSONArrayReader(r *bufio.Reader, closer io.Closer) (*jsonlReader, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, errors.New("not a json array")
+	}
+	j := &jsonlReader{closer: closer, index: make(map[string]int)}
+	done := false
+	j.next = func() ([]byte, error) {
+		if done || !dec.More() {
+			if !done {
+				done = true
+				if _, err := dec.Token(); err != nil {
+					return nil, err
+				}
+			}
+			return nil, io.EOF
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("element %d: %w", j.line+1, err)
+		}
+		j.line++
+		return raw, nil
+	}
+	return j, j.readHeader()
+}
+
+func (j *jsonlReader) readHeader() error {
+	data, err := j.next()
+	if err == io.EOF {
+		return errors.New("empty dataset")
+	}
+	if err != nil {
+		return err
+	}
+	keys, values, err := decodeObject(data)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", j.line, err)
+	}
+	for _, k := range keys {
+		j.index[k] = len(j.header)
+		j.header = append(j.header, k)
+	}
+	j.first = j.record(values)
+	return nil
+}
+
+func (j *jsonlReader) Header() []string { return j.header }
+func (j *jsonlReader) Line() int        { return j.line }
+func (j *jsonlReader) Close() error     { return j.closer.Close() }
+
+// 读取下一个非空行；超过 maxRecordBytes 的行丢弃，返回该行的格式错误
+func (j *jsonlReader) readLine(r *bufio.Reader) ([]byte, error) {
+	for {
+		data, err := readLimitedLine(r, maxRecordBytes)
+		if err == errLineTooLong {
+			j.line++
+			return nil, &RowParseError{Line: j.line, Err: fmt.Errorf("line exceeds %d bytes", maxRecordBytes)}
+		}
+		if len(data) == 0 && err != nil {
+			return nil, err
+		}
+		j.line++
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// 同 ReadBytes('\n')，一行超过 limit 字节时丢弃该行剩余部分，返回 errLineTooLong
+func readLimitedLine(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			return nil, errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+func (j *jsonlReader) Read() ([]*string, error) {
+	if j.first != nil {
+		record := j.first
+		j.first = nil
+		return record, nil
+	}
+	data, err := j.next()
+	if err != nil {
+		return nil, err
+	}
+	_, values, err := decodeObject(data)
+	if err != nil {
+		return nil, &RowParseError{Line: j.line, Err: err}
+	}
+	return j.record(values), nil
+}
+
+// 按表头排列字段值，不在表头中的字段忽略，缺少的字段为 NULL
+func (j *jsonlReader) record(values map[string]json.RawMessage) []*string {
+	record := make([]*string, len(j.header))
+	for k, raw := range values {
+		if i, ok := j.index[k]; ok {
+			record[i] = jsonValue(raw)
+		}
+	}
+	return record
+}
+
+// 解析 JSON 对象，返回字段顺序和原始值
+func decodeObject(data []byte) ([]string, map[string]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, errors.New("not a json object")
+	}
+	var keys []string
+	values := make(map[string]json.RawMessage)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, _ := tok.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = raw
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, nil, err
+	}
+	return keys, values, nil
+}
+
+// 字符串取值本身，null 为 nil，其余（数字、布尔、嵌套对象）保留 JSON 文本
+func jsonValue(raw json.RawMessage) *string {
+	if string(raw) == "null" {
+		return nil
+	}
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			return &s
+		}
+	}
+	s := string(raw)
+	return &s
+}
+
+// ================================
+// Parquet：按批读取，内存占用为一个批次
+// ================================
+const parquetBatchSize = 8192
+
+type parquetReader struct {
+	pf     *file.Reader
+	rr     pqarrow.RecordReader
+	header []string
+	rec    arrow.Record
+	row    int
+	line   int
+}
+
+func newParquetReader(path string) (*parquetReader, error) {
+	pf, err := file.OpenParquetFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	fr, err := pqarrow.NewFileReader(pf, pqarrow.ArrowReadProperties{BatchSize: parquetBatchSize}, memory.DefaultAllocator)
+	if err != nil {
+		pf.Close()
+		return nil, err
+	}
+	rr, err := fr.GetRecordReader(context.Background(), nil, nil)
+	if err != nil {
+		pf.Close()
+		return nil, err
+	}
+	p := &parquetReader{pf: pf, rr: rr}
+	for _, field := range rr.Schema().Fields() {
+		p.header = append(p.header, field.Name)
+	}
+	return p, nil
+}
+
+func (p *parquetReader) Header() []string { return p.header }
+func (p *parquetReader) Line() int        { return p.line }
+
+func (p *parquetReader) Read() ([]*string, error) {
+	for p.rec == nil || p.row >= int(p.rec.NumRows()) {
+		if p.rec != nil {
+			p.rec.Release()
+			p.rec = nil
+		}
+		if !p.rr.Next() {
+			if err := p.rr.Err(); err != nil && err != io.EOF {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		p.rec = p.rr.Record()
+		p.rec.Retain()
+		p.row = 0
+	}
+	record := make([]*string, len(p.header))
+	for i := range record {
+		if col := p.rec.Column(i); !col.IsNull(p.row) {
+			v := col.ValueStr(p.row)
+			record[i] = &v
+		}
+	}
+	p.row++
+	p.line++
+	return record, nil
+}
+
+func (p *parquetReader) Close() error {
+	if p.rec != nil {
+		p.rec.Release()
+	}
+	p.rr.Release()
+	return p.pf.Close()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 读取全部记录，NULL 记为 <nil>，格式错误的行记为 error@行号
+func readAll(t *testing.T, reader DatasetReader) []string {
+	t.Helper()
+	var rows []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows
+		}
+		var perr *RowParseError
+		if errors.As(err, &perr) {
+			rows = append(rows, "error@"+strconv.Itoa(perr.Line))
+			continue
+		}
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		fields := make([]string, len(record))
+		for i, v := range record {
+			fields[i] = str(v)
+		}
+		rows = append(rows, strings.Join(fields, ",")+"@"+strconv.Itoa(reader.Line()))
+	}
+}
+
+func TestDelimitedReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		df     DataFormat
+		input  string
+		header []string
+		rows   []string
+	}{
+		{
+			name:   "sniff semicolon",
+			format: FormatCSV,
+			input:  "a;b\n1;2\n",
+			header: []string{"a", "b"},
+			rows:   []string{`"1","2"@2`},
+		},
+		{
+			name:   "tsv",
+			format: FormatTSV,
+			input:  "a\tb\n1\t\n",
+			header: []string{"a", "b"},
+			rows:   []string{`"1",""@2`},
+		},
+		{
+			name:   "quoted fields with newline and escaped quote",
+			format: FormatCSV,
+			input:  "a,b\r\n\"x,\"\"y\"\"\",\"l1\nl2\"\r\n3,4",
+			header: []string{"a", "b"},
+			rows:   []string{`"x,"y"","l1` + "\n" + `l2"@2`, `"3","4"@4`},
+		},
+		{
+			name:   "skip blank lines",
+			format: FormatCSV,
+			input:  "a\n\n1\n\n2\n",
+			header: []string{"a"},
+			rows:   []string{`"1"@3`, `"2"@5`},
+		},
+		{
+			name:   "quoted empty line is a value",
+			format: FormatCSV,
+			input:  "a\n\"\"\n",
+			header: []string{"a"},
+			rows:   []string{`""@2`},
+		},
+		{
+			name:   "no quote",
+			format: FormatCSV,
+			df:     DataFormat{Quote: "none", Delimiter: "|"},
+			input:  "a|b\n\"1\"|2\n",
+			header: []string{"a", "b"},
+			rows:   []string{`""1"","2"@2`},
+		},
+		{
+			name:   "cr line ending",
+			format: FormatCSV,
+			df:     DataFormat{LineEnding: "cr"},
+			input:  "a,b\r1,2\n3\r",
+			header: []string{"a", "b"},
+			rows:   []string{`"1","2` + "\n" + `3"@2`},
+		},
+		{
+			name:   "unterminated quote",
+			format: FormatCSV,
+			input:  "a\n1\n\"2\n",
+			header: []string{"a"},
+			rows:   []string{`"1"@2`, "error@3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			df := tt.df
+			reader, err := newDelimitedReader(bufio.NewReader(strings.NewReader(tt.input)), io.NopCloser(nil), tt.format, &df)
+			if err != nil {
+				t.Fatalf("newDelimitedReader: %v", err)
+			}
+			if !reflect.DeepEqual(reader.Header(), tt.header) {
+				t.Errorf("header = %q, want %q", reader.Header(), tt.header)
+			}
+			if rows := readAll(t, reader); !reflect.DeepEqual(rows, tt.rows) {
+				t.Errorf("rows = %q, want %q", rows, tt.rows)
+			}
+		})
+	}
+}
+
+func TestDelimitedReaderEmpty(t *testing.T) {
+	_, err := newDelimitedReader(bufio.NewReader(strings.NewReader("\n")), io.NopCloser(nil), FormatCSV, &DataFormat{})
+	if err == nil {
+		t.Fatal("want error for empty dataset")
+	}
+}
+
+func TestJSONReaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		input  string
+		header []string
+		rows   []string
+	}{
+		{
+			name:   "jsonl null and missing keys are NULL",
+			file:   "data.jsonl",
+			input:  `{"a":"x","b":null}` + "\n\n" + `{"b":""}` + "\n" + `{"a":1,"b":{"c":true},"d":2}` + "\n",
+			header: []string{"a", "b"},
+			rows:   []string{`"x",<nil>@1`, `<nil>,""@3`, `"1","{"c":true}"@4`},
+		},
+		{
+			name:   "jsonl bad line",
+			file:   "data.jsonl",
+			input:  `{"a":1}` + "\n[1]\n" + `{"a":2}`,
+			header: []string{"a"},
+			rows:   []string{`"1"@1`, "error@2", `"2"@3`},
+		},
+		{
+			name:   "json array",
+			file:   "data.json",
+			input:  "[\n  {\"a\": \"x\", \"b\": null},\n  {\"a\": \"\"},\n  3\n]\n",
+			header: []string{"a", "b"},
+			rows:   []string{`"x",<nil>@1`, `"",<nil>@2`, "error@3"},
+		},
+		{
+			name:   "json array detected by content",
+			file:   "data",
+			input:  `[{"a":1}]`,
+			header: []string{"a"},
+			rows:   []string{`"1"@1`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "input")
+			if err := os.WriteFile(path, []byte(tt.input), 0644); err != nil {
+				t.Fatal(err)
+			}
+			reader, err := openDataset(path, tt.file, nil)
+			if err != nil {
+				t.Fatalf("openDataset: %v", err)
+			}
+			defer reader.Close()
+			if !reflect.DeepEqual(reader.Header(), tt.header) {
+				t.Errorf("header = %q, want %q", reader.Header(), tt.header)
+			}
+			if rows := readAll(t, reader); !reflect.DeepEqual(rows, tt.rows) {
+				t.Errorf("rows = %q, want %q", rows, tt.rows)
+			}
+		})
+	}
+}
+
+func TestJSONArrayReaderErrors(t *testing.T) {
+	for _, input := range []string{`[]`, `{"a":1}`, `[{"a":1}`} {
+		path := filepath.Join(t.TempDir(), "input")
+		if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := openDataset(path, "data.json", nil)
+		if err == nil {
+			_, err = reader.Read()
+			if err == nil {
+				_, err = reader.Read()
+			}
+			reader.Close()
+		}
+		if err == nil || err == io.EOF {
+			t.Errorf("%s: want error, got %v", input, err)
+		}
+	}
+}
+
+func TestReaderSizeLimits(t *testing.T) {
+	savedField, savedRecord := maxFieldBytes, maxRecordBytes
+	maxFieldBytes, maxRecordBytes = 8, 20
+	t.Cleanup(func() { maxFieldBytes, maxRecordBytes = savedField, savedRecord })
+
+	tests := []struct {
+		name  string
+		input string
+		rows  []string
+	}{
+		{
+			name:  "unbalanced quote stops at field limit",
+			input: "a,b\n\"x\n3,4\n5,6\n7,8\n",
+			rows:  []string{"error@2", `"7","8"@5`},
+		},
+		{
+			name:  "long field",
+			input: "a,b\n1,2\n123456789,3\n4,5",
+			rows:  []string{`"1","2"@2`, "error@3", `"4","5"@4`},
+		},
+		{
+			name:  "long record",
+			input: "a,b,c,d\n12345678,12345678,1234,5\n1,2,3,4\n",
+			rows:  []string{"error@2", `"1","2","3","4"@3`},
+		},
+	}
+	for _, tt := range tests {
+		reader, err := newDelimitedReader(bufio.NewReader(strings.NewReader(tt.input)), io.NopCloser(nil), FormatCSV, &DataFormat{})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if rows := readAll(t, reader); !reflect.DeepEqual(rows, tt.rows) {
+			t.Errorf("%s: rows = %q, want %q", tt.name, rows, tt.rows)
+		}
+	}
+
+	// 超过 bufio 缓冲区的长行
+	input := `{"a":1}` + "\n" + `{"a":"` + strings.Repeat("x", 100) + `"}` + "\n" + `{"a":2}`
+	reader, err := newJSONLReader(bufio.NewReaderSize(strings.NewReader(input), 16), io.NopCloser(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows, want := readAll(t, reader), []string{`"1"@1`, "error@2", `"2"@3`}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("jsonl rows = %q, want %q", rows, want)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		dtype   string
+		value   string
+		want    *string
+		wantErr bool
+	}{
+		{DtypeString, "", ptr(""), false},
+		{DtypeString, " a b ", ptr(" a b "), false},
+		{DtypeInt64, "", nil, false},
+		{DtypeInt64, " 42 ", ptr("42"), false},
+		{DtypeInt64, "-7", ptr("-7"), false},
+		{DtypeInt64, "4.2", nil, true},
+		{DtypeInt64, "abc", nil, true},
+		{DtypeFloat64, "", nil, false},
+		{DtypeFloat64, "3.14 ", ptr("3.14"), false},
+		{DtypeFloat64, "1e3", ptr("1e3"), false},
+		{DtypeFloat64, "x", nil, true},
+		{DtypeDatetime, "2024-01-02", ptr("2024-01-02 00:00:00"), false},
+		{DtypeDatetime, "2024/01/02 03:04:05", ptr("2024-01-02 03:04:05"), false},
+		{DtypeDatetime, "2024-01-02T03:04:05Z", ptr("2024-01-02 03:04:05"), false},
+		{DtypeDatetime, "1700000000", nil, true},
+		{DtypeTimestamp, "1700000000", ptr("2023-11-14 22:13:20"), false},
+		{DtypeTimestamp, "yesterday", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseValue(tt.dtype, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseValue(%s, %q) err = %v, wantErr %v", tt.dtype, tt.value, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("parseValue(%s, %q) = %v, want %v", tt.dtype, tt.value, str(got), str(tt.want))
+		}
+	}
+}
+
+func TestInferDtype(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		{"empty", nil, DtypeString},
+		{"all blank", []string{"", ""}, DtypeString},
+		{"ints", []string{"1", "", " 2", "-3"}, DtypeInt64},
+		{"ints and floats", []string{"1", "2.5"}, DtypeFloat64},
+		{"dates", []string{"2024-01-02", "2024-01-03 04:05:06"}, DtypeDatetime},
+		{"dates and text", []string{"2024-01-02", "n/a"}, DtypeString},
+		{"mixed", []string{"1", "a"}, DtypeString},
+	}
+	for _, tt := range tests {
+		if got := inferDtype(tt.values); got != tt.want {
+			t.Errorf("%s: inferDtype(%q) = %s, want %s", tt.name, tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestEstimateDistinct(t *testing.T) {
+	tests := []struct {
+		name                                 string
+		distinct, singletons, sampled, total int64
+		want                                 int64
+	}{
+		{"full scan", 10, 4, 100, 100, 10},
+		{"empty", 0, 0, 0, 0, 0},
+		{"all unique", 100, 100, 100, 400, 200},
+		{"no singletons", 5, 0, 100, 10000, 5},
+		{"mixed", 50, 20, 100, 10000, 230},
+		{"sample close to total", 100, 100, 100, 101, 100},
+	}
+	for _, tt := range tests {
+		if got := estimateDistinct(tt.distinct, tt.singletons, tt.sampled, tt.total); got != tt.want {
+			t.Errorf("%s: estimateDistinct = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func ptr(s string) *string { return &s }
+
+// 测试输出中区分 NULL 和空字符串
+func str(s *string) string {
+	if s == nil {
+		return "<nil>"
+	}
+	return "\"" + *s + "\""
+}
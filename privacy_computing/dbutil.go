@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"sync"
@@ -53,9 +54,12 @@ func TableExists(db *sql.DB, database, table string) (bool, error) {
 // 3. 获取表数据量
 // ================================
 func TableCount(db *sql.DB, database, table string) (int64, error) {
-	query := fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", database, table)
+	name, err := quoteTable(database, table)
+	if err != nil {
+		return 0, err
+	}
 	var count int64
-	err := db.QueryRow(query).Scan(&count)
+	err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", name)).Scan(&count)
 	return count, err
 }
 
@@ -63,7 +67,11 @@ func TableCount(db *sql.DB, database, table string) (int64, error) {
 // 4. 获取表内容（limit/offset 可选）
 // ================================
 func GetTableRows(db *sql.DB, sqlstr string, args ...interface{}) ([]map[string]interface{}, error) {
-	rows, err := db.Query(sqlstr, args...)
+	return GetTableRowsContext(context.Background(), db, sqlstr, args...)
+}
+
+func GetTableRowsContext(ctx context.Context, db *sql.DB, sqlstr string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.QueryContext(ctx, sqlstr, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -100,3 +108,8 @@ func ExecSQL(db *sql.DB, sqlText string, args ...interface{}) error {
 	_, err := db.Exec(sqlText, args...)
 	return err
 }
+
+func ExecSQLContext(ctx context.Context, db *sql.DB, sqlText string, args ...interface{}) error {
+	_, err := db.ExecContext(ctx, sqlText, args...)
+	return err
+}
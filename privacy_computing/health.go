@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+	log "github.com/sirupsen/logrus"
+)
+
+// 就绪检查项
+const (
+	CheckMySQL       = "mysql"        // 通过 GetDB 连接并 ping
+	CheckBroker      = "broker"       // 调用 broker intra API（ListProjects）
+	CheckBrokerInter = "broker_inter" // broker inter 服务返回 HTTP 响应
+	CheckEngine      = "engine"       // engine 的 /health 返回 200
+)
+
+var allChecks = []string{CheckMySQL, CheckBroker, CheckBrokerInter, CheckEngine}
+
+// 单项检查的超时
+const checkTimeout = 5 * time.Second
+
+// broker inter 服务地址，环境变量 BROKER_INTER_URL，默认 http://127.0.0.1:8081
+func brokerInterURL() string {
+	if v := os.Getenv("BROKER_INTER_URL"); v != "" {
+		return v
+	}
+	return "http://127.0.0.1:8081"
+}
+
+// engine 健康检查地址，环境变量 ENGINE_HEALTH_URL，默认 https://127.0.0.1:8003/health
+func engineHealthURL() string {
+	if v := os.Getenv("ENGINE_HEALTH_URL"); v != "" {
+		return v
+	}
+	return "https://127.0.0.1:8003/health"
+}
+
+// 本机 engine 使用自签名证书，只用于检查本机服务
+var probeClient = &http.Client{
+	Timeout:   checkTimeout,
+	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+}
+
+var readinessChecks = map[string]func(ctx context.Context) error{
+	CheckMySQL:       checkMySQL,
+	CheckBroker:      checkBroker,
+	CheckBrokerInter: checkBrokerInter,
+	CheckEngine:      checkEngine,
+}
+
+func checkMySQL(ctx context.Context) error {
+	db, err := GetDB(dsn)
+	if db == nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	return db.PingContext(ctx)
+}
+
+func checkBroker(ctx context.Context) error {
+	_, err := brokerCall(ctx, func() (*pb.ListProjectsResponse, error) {
+		return brokerCommand.GetProject("")
+	})
+	return err
+}
+
+// inter 服务没有健康检查接口，任意 HTTP 响应都说明服务已启动
+func checkBrokerInter(ctx context.Context) error {
+	resp, err := probe(ctx, brokerInterURL())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func checkEngine(ctx context.Context) error {
+	resp, err := probe(ctx, engineHealthURL())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", engineHealthURL(), resp.Status)
+	}
+	return nil
+}
+
+func probe(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return probeClient.Do(req)
+}
+
+// 单项检查结果
+type CheckResult struct {
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+type ReadinessReport struct {
+	Ready     bool          `json:"ready"`
+	Checks    []CheckResult `json:"checks"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// 未通过的检查及原因
+func (r *ReadinessReport) Err() error {
+	var failed []string
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed = append(failed, c.Name+": "+c.Error)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return errors.New("not ready: " + strings.Join(failed, "; "))
+}
+
+// 并发执行检查项 names，为空时执行全部
+func checkReadiness(ctx context.Context, names ...string) *ReadinessReport {
+	if len(names) == 0 {
+		names = allChecks
+	}
+	report := &ReadinessReport{Ready: true, Checks: make([]CheckResult, len(names)), CheckedAt: time.Now()}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			start := time.Now()
+			result := CheckResult{Name: name, OK: true}
+			if err := readinessChecks[name](ctx); err != nil {
+				result.OK = false
+				result.Error = err.Error()
+			}
+			result.LatencyMs = time.Since(start).Milliseconds()
+			report.Checks[i] = result
+		}()
+	}
+	wg.Wait()
+	for _, c := range report.Checks {
+		report.Ready = report.Ready && c.OK
+	}
+	return report
+}
+
+// 等待检查项全部通过后再继续当前阶段，按 ready 的退避参数重试，超过 max_elapsed 时阶段失败
+func (t *taskRunner) waitReady(ctx context.Context, names ...string) error {
+	return t.withRetry(ctx, RetryReady, "wait for "+strings.Join(names, "/"), func(int) error {
+		report := checkReadiness(ctx, names...)
+		if err := report.Err(); err != nil {
+			return err
+		}
+		log.Debugf("[task=%s] %s ready", t.taskID, strings.Join(names, "/"))
+		return nil
+	})
+}
+
+// 存活检查：服务进程可以处理请求
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// 就绪检查：MySQL、broker 和 engine 都可用时返回 200，否则返回 503 和各项的失败原因；
+// check 参数可指定检查项，如 ?check=mysql,engine
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	var names []string
+	if v := r.URL.Query().Get("check"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			if _, ok := readinessChecks[name]; !ok {
+				http.Error(w, "unknown check "+name, http.StatusBadRequest)
+				return
+			}
+			names = append(names, name)
+		}
+	}
+	report := checkReadiness(r.Context(), names...)
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 替换检查项，测试结束后恢复
+func stubChecks(t *testing.T, checks map[string]func(ctx context.Context) error) {
+	saved := readinessChecks
+	readinessChecks = checks
+	t.Cleanup(func() { readinessChecks = saved })
+}
+
+func TestCheckReadiness(t *testing.T) {
+	stubChecks(t, map[string]func(ctx context.Context) error{
+		CheckMySQL:       func(context.Context) error { return nil },
+		CheckBroker:      func(context.Context) error { return errors.New("connection refused") },
+		CheckBrokerInter: func(context.Context) error { return nil },
+		CheckEngine:      func(context.Context) error { return nil },
+	})
+
+	tests := []struct {
+		name      string
+		checks    []string
+		wantReady bool
+		wantErr   string
+	}{
+		{"all", nil, false, "broker: connection refused"},
+		{"selected ok", []string{CheckMySQL, CheckEngine}, true, ""},
+		{"selected failing", []string{CheckBroker}, false, "not ready: broker: connection refused"},
+	}
+	for _, tt := range tests {
+		report := checkReadiness(context.Background(), tt.checks...)
+		if report.Ready != tt.wantReady {
+			t.Errorf("%s: ready = %v, want %v", tt.name, report.Ready, tt.wantReady)
+		}
+		want := len(tt.checks)
+		if want == 0 {
+			want = len(allChecks)
+		}
+		if len(report.Checks) != want {
+			t.Errorf("%s: %d checks, want %d", tt.name, len(report.Checks), want)
+		}
+		err := report.Err()
+		if (tt.wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	stubChecks(t, map[string]func(ctx context.Context) error{
+		CheckMySQL:  func(context.Context) error { return nil },
+		CheckEngine: func(context.Context) error { return errors.New("down") },
+	})
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"?check=mysql", http.StatusOK},
+		{"?check=mysql,engine", http.StatusServiceUnavailable},
+		{"?check=redis", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: status = %d, want %d", tt.query, w.Code, tt.code)
+		}
+		if tt.code == http.StatusBadRequest {
+			continue
+		}
+		var report ReadinessReport
+		if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+			t.Errorf("%s: decode: %v", tt.query, err)
+		} else if report.Ready != (tt.code == http.StatusOK) {
+			t.Errorf("%s: ready = %v", tt.query, report.Ready)
+		}
+	}
+}
+
+func TestCheckEngine(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	t.Setenv("ENGINE_HEALTH_URL", srv.URL+"/health")
+
+	if err := checkEngine(context.Background()); err != nil {
+		t.Errorf("healthy engine: %v", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := checkEngine(context.Background()); err == nil {
+		t.Error("want error for 503")
+	}
+	// broker inter 服务任意 HTTP 响应都视为已启动
+	t.Setenv("BROKER_INTER_URL", srv.URL)
+	if err := checkBrokerInter(context.Background()); err != nil {
+		t.Errorf("broker inter: %v", err)
+	}
+	srv.Close()
+	if err := checkBrokerInter(context.Background()); err == nil {
+		t.Error("want error when the service is down")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MySQL 标识符最大长度
+const maxIdentLen = 64
+
+// 可以直接用于 MySQL 和 SCQL 查询的标识符
+var safeIdentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var unsafeIdentCharsRe = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// MySQL / SCQL 的保留字，不能作为列名
+var reservedWords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`
+		ACCESSIBLE ADD ALL ALTER ANALYZE AND AS ASC BETWEEN BIGINT BINARY BLOB BOTH BY CALL CASCADE CASE
+		CHANGE CHAR CHARACTER CHECK COLLATE COLUMN CONDITION CONSTRAINT CONTINUE CONVERT CREATE CROSS
+		CURRENT_DATE CURRENT_TIME CURRENT_TIMESTAMP CURRENT_USER CURSOR DATABASE DATABASES DAY_HOUR
+		DEC DECIMAL DECLARE DEFAULT DELETE DESC DESCRIBE DISTINCT DIV DOUBLE DROP DUAL EACH ELSE ELSEIF
+		ENCLOSED ESCAPED EXCEPT EXISTS EXIT EXPLAIN FALSE FETCH FLOAT FOR FORCE FOREIGN FROM FULLTEXT
+		GENERATED GET GRANT GROUP HAVING HIGH_PRIORITY IF IGNORE IN INDEX INFILE INNER INOUT INSERT INT
+		INTEGER INTERSECT INTERVAL INTO IS ITERATE JOIN KEY KEYS KILL LEADING LEAVE LEFT LIKE LIMIT LINES
+		LOAD LOCALTIME LOCALTIMESTAMP LOCK LONG LOOP LOW_PRIORITY MATCH MOD MODIFIES NATURAL NOT NULL
+		NUMERIC ON OPTIMIZE OPTION OPTIONALLY OR ORDER OUT OUTER OUTFILE OVER PARTITION PRECISION PRIMARY
+		PROCEDURE RANGE RANK READ REAL REFERENCES REGEXP RELEASE RENAME REPEAT REPLACE REQUIRE RESTRICT
+		RETURN REVOKE RIGHT RLIKE ROW ROWS SCHEMA SELECT SEPARATOR SET SHOW SMALLINT SPATIAL SQL
+		STARTING STORED TABLE TERMINATED THEN TINYINT TO TRAILING TRIGGER TRUE UNION UNIQUE UNLOCK
+		UNSIGNED UPDATE USAGE USE USING VALUES VARCHAR VARYING VIRTUAL WHEN WHERE WHILE WINDOW WITH
+		WRITE XOR`) {
+		reservedWords[w] = true
+	}
+}
+
+// 校验标识符：非空、不超过 maxIdentLen、不含控制字符
+func validateIdent(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty identifier")
+	}
+	if len(name) > maxIdentLen {
+		return fmt.Errorf("identifier %q longer than %d", name, maxIdentLen)
+	}
+	if strings.HasSuffix(name, " ") {
+		return fmt.Errorf("identifier %q ends with space", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("identifier %q contains control character", name)
+		}
+	}
+	return nil
+}
+
+// 用反引号引用 MySQL 标识符
+func quoteIdent(name string) (string, error) {
+	if err := validateIdent(name); err != nil {
+		return "", err
+	}
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`", nil
+}
+
+// 引用 db.table 形式的表名
+func quoteTable(database, table string) (string, error) {
+	db, err := quoteIdent(database)
+	if err != nil {
+		return "", err
+	}
+	t, err := quoteIdent(table)
+	if err != nil {
+		return "", err
+	}
+	return db + "." + t, nil
+}
+
+// 引用 SQL 字符串字面量，只用于不支持占位符的语句（LOAD DATA INFILE 的文件名、SCQL 的 INTO OUTFILE），
+// 其余的值都作为查询参数传入。反斜杠的含义取决于 NO_BACKSLASH_ESCAPES，引号和反斜杠都无法可靠转义，直接拒绝
+func quoteLiteral(s string) (string, error) {
+	if strings.ContainsAny(s, `'"\`) {
+		return "", fmt.Errorf("%q contains quote or backslash", s)
+	}
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f {
+			return "", fmt.Errorf("%q contains control character", s)
+		}
+	}
+	return "'" + s + "'", nil
+}
+
+// 名称是否可以不经引用直接出现在 SQL 中
+func isSafeIdent(name string) bool {
+	return len(name) <= maxIdentLen && safeIdentRe.MatchString(name) && !reservedWords[strings.ToUpper(name)]
+}
+
+// 把任意名称转换为安全标识符：非法字符替换为 _，数字开头或保留字加前缀，
+// 没有可用字符（例如中文列名）时使用 fallback
+func sanitizeIdent(name, fallback string) string {
+	s := strings.Trim(unsafeIdentCharsRe.ReplaceAllString(strings.TrimSpace(name), "_"), "_")
+	if s == "" {
+		s = fallback
+	}
+	if s[0] >= '0' && s[0] <= '9' || reservedWords[strings.ToUpper(s)] {
+		s = "c_" + s
+	}
+	if len(s) > maxIdentLen {
+		s = s[:maxIdentLen]
+	}
+	return s
+}
+
+// CSV 表头到安全列名的映射，重名时加 _2、_3 后缀
+func safeColumnNames(header []string) []string {
+	names := make([]string, len(header))
+	used := make(map[string]bool)
+	for i, raw := range header {
+		name := raw
+		if !isSafeIdent(name) {
+			name = sanitizeIdent(raw, fmt.Sprintf("col_%d", i+1))
+		}
+		base := name
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			suffix := "_" + strconv.Itoa(n)
+			name = base[:min(len(base), maxIdentLen-len(suffix))] + suffix
+		}
+		used[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+// 任务使用的 MySQL 表名 <user>_<task_id 前 8 位>
+func taskTableName(user, taskID string) string {
+	id := shortTaskID(taskID)
+	name := sanitizeIdent(user, "t")
+	return name[:min(len(name), maxIdentLen-len(id)-1)] + "_" + id
+}
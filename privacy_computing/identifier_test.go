@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeIdent(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback string
+		want     string
+	}{
+		{"age", "col_1", "age"},
+		{" user id ", "col_1", "user_id"},
+		{"a-b.c", "col_1", "a_b_c"},
+		{"__x__", "col_1", "x"},
+		{"1st", "col_1", "c_1st"},
+		{"order", "col_1", "c_order"},
+		{"Select", "col_1", "c_Select"},
+		{"年龄", "col_3", "col_3"},
+		{"年龄age", "col_3", "age"},
+		{"", "t", "t"},
+		{strings.Repeat("a", 70), "col_1", strings.Repeat("a", maxIdentLen)},
+		{"9" + strings.Repeat("a", 70), "col_1", "c_9" + strings.Repeat("a", maxIdentLen-3)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeIdent(tt.name, tt.fallback); got != tt.want {
+			t.Errorf("sanitizeIdent(%q, %q) = %q, want %q", tt.name, tt.fallback, got, tt.want)
+		}
+	}
+}
+
+func TestSafeColumnNames(t *testing.T) {
+	long := strings.Repeat("x", maxIdentLen)
+	tests := []struct {
+		name   string
+		header []string
+		want   []string
+	}{
+		{"safe names unchanged", []string{"id", "Age", "_x1"}, []string{"id", "Age", "_x1"}},
+		{"unsafe names", []string{"user id", "key", "3d", "姓名"}, []string{"user_id", "c_key", "c_3d", "col_4"}},
+		{"duplicates ignore case", []string{"a", "A", "a b", "a_b"}, []string{"a", "A_2", "a_b", "a_b_2"}},
+		{"duplicate fallback", []string{"姓名", "col_1"}, []string{"col_1", "col_1_2"}},
+		{"suffix keeps length", []string{long, long}, []string{long, long[:maxIdentLen-2] + "_2"}},
+	}
+	for _, tt := range tests {
+		if got := safeColumnNames(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: safeColumnNames(%q) = %q, want %q", tt.name, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"/home/user/tasks/abc/load.csv", "'/home/user/tasks/abc/load.csv'", false},
+		{"alice", "'alice'", false},
+		{"", "''", false},
+		{"a'b", "", true},
+		{`a"b`, "", true},
+		{`C:\tmp`, "", true},
+		{"a\nb", "", true},
+	}
+	for _, tt := range tests {
+		got, err := quoteLiteral(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("quoteLiteral(%q) = %q, %v, want %q, wantErr %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+	log "github.com/sirupsen/logrus"
+)
+
+// 协作方对不匹配的邀请的处理方式
+const (
+	UnmatchedIgnore = "ignore" // 不处理，留给其他任务（默认）
+	UnmatchedReject = "reject" // 拒绝
+)
+
+// 协作方接受的邀请
+type InvitationRecord struct {
+	InvitationID uint64    `json:"invitation_id"`
+	ProjectID    string    `json:"project_id"`
+	Inviter      string    `json:"inviter"`
+	AcceptedAt   time.Time `json:"accepted_at"`
+}
+
+func (req *RunPrivacyRequest) unmatchedInvitations() string {
+	if req.UnmatchedInvitations == "" {
+		return UnmatchedIgnore
+	}
+	return strings.ToLower(req.UnmatchedInvitations)
+}
+
+// 校验协作方等待的邀请：邀请方需为协作方之一
+func validateInvitation(req *RunPrivacyRequest) error {
+	switch strings.ToLower(req.UnmatchedInvitations) {
+	case "", UnmatchedIgnore, UnmatchedReject:
+	default:
+		return fmt.Errorf("not support unmatched_invitations %v", req.UnmatchedInvitations)
+	}
+	if req.Inviter == "" {
+		return nil
+	}
+	if !slices.ContainsFunc(req.partners(), func(p Party) bool { return p.User == req.Inviter }) {
+		return fmt.Errorf("inviter %s is not a party", req.Inviter)
+	}
+	return nil
+}
+
+// 邀请是否是本任务等待的：邀请本方、邀请方为 inviter（默认为任一协作方）、项目为 project_id（指定时）。
+// 已接受的邀请只在指定了 project_id 时匹配，用于恢复执行
+func (req *RunPrivacyRequest) matchInvitation(inv *pb.ProjectInvitation) bool {
+	if inv.GetInvitee() != "" && inv.GetInvitee() != req.User {
+		return false
+	}
+	switch inv.GetStatus() {
+	case pb.InvitationStatus_UNDECIDED:
+	case pb.InvitationStatus_ACCEPTED:
+		if req.ProjectID == "" {
+			return false
+		}
+	default:
+		return false
+	}
+	if req.ProjectID != "" && inv.GetProject().GetProjectId() != req.ProjectID {
+		return false
+	}
+	if req.Inviter != "" {
+		return inv.GetInviter() == req.Inviter
+	}
+	return slices.ContainsFunc(req.partners(), func(p Party) bool { return p.User == inv.GetInviter() })
+}
+
+func listInvitations(ctx context.Context) ([]*pb.ProjectInvitation, error) {
+	response, err := brokerCall(ctx, brokerCommand.GetInvitation)
+	if err != nil {
+		return nil, err
+	}
+	return response.GetInvitations(), nil
+}
+
+// 查找并接受本任务等待的邀请，没有或邀请已被其他任务接受时返回 nil；多个邀请匹配时接受最新的一个。
+// unmatched_invitations 为 reject 时拒绝其余未处理的邀请
+func (t *taskRunner) acceptInvitation(ctx context.Context) (*pb.ProjectInvitation, error) {
+	invitations, err := listInvitations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matched []*pb.ProjectInvitation
+	for _, inv := range invitations {
+		if t.req.matchInvitation(inv) {
+			matched = append(matched, inv)
+			continue
+		}
+		if inv.GetStatus() != pb.InvitationStatus_UNDECIDED {
+			continue
+		}
+		if t.req.unmatchedInvitations() != UnmatchedReject {
+			log.Debugf("[task=%s] ignore invitation %d to %s from %s", t.taskID, inv.GetInvitationId(), inv.GetProject().GetProjectId(), inv.GetInviter())
+			continue
+		}
+		if err := processInvitation(ctx, inv.GetInvitationId(), false); err != nil {
+			log.Errorf("[task=%s] reject invitation %d err:%s", t.taskID, inv.GetInvitationId(), err.Error())
+			continue
+		}
+		emitEvent(t.taskID, EventInvitation, map[string]any{"invitation_id": inv.GetInvitationId(), "project": inv.GetProject().GetProjectId(), "inviter": inv.GetInviter(), "action": "rejected"},
+			"rejected invitation to %s from %s", inv.GetProject().GetProjectId(), inv.GetInviter())
+	}
+	if len(matched) == 0 {
+		return nil, nil
+	}
+	inv := slices.MaxFunc(matched, func(a, b *pb.ProjectInvitation) int {
+		return cmp.Compare(a.GetInvitationId(), b.GetInvitationId())
+	})
+	if len(matched) > 1 {
+		log.Warnf("[task=%s] %d invitations matched, accept the latest one %d; set project_id to choose", t.taskID, len(matched), inv.GetInvitationId())
+	}
+	if inv.GetStatus() == pb.InvitationStatus_ACCEPTED {
+		return inv, nil
+	}
+	// 邀请已被处理（如被其他任务接受）时 broker 返回 NotFound，不能认领该项目，继续等待
+	err = processInvitation(ctx, inv.GetInvitationId(), true)
+	if errors.Is(err, ErrNotFound) {
+		log.Warnf("[task=%s] invitation %d to %s already processed by others", t.taskID, inv.GetInvitationId(), inv.GetProject().GetProjectId())
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// 记录接受的邀请和项目
+func (t *taskRunner) setInvitation(inv *pb.ProjectInvitation) {
+	t.projectID = inv.GetProject().GetProjectId()
+	record := &InvitationRecord{
+		InvitationID: inv.GetInvitationId(),
+		ProjectID:    t.projectID,
+		Inviter:      inv.GetInviter(),
+		AcceptedAt:   time.Now(),
+	}
+	updateTask(t.taskID, func(rec *TaskRecord) {
+		rec.ProjectID = t.projectID
+		rec.Invitation = record
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+)
+
+func TestMatchInvitation(t *testing.T) {
+	invitation := func(project, inviter, invitee string, status pb.InvitationStatus) *pb.ProjectInvitation {
+		return &pb.ProjectInvitation{
+			Project: &pb.ProjectDesc{ProjectId: project},
+			Inviter: inviter,
+			Invitee: invitee,
+			Status:  status,
+		}
+	}
+	base := RunPrivacyRequest{User: "bob", Parties: []Party{{User: "alice"}, {User: "carol"}}}
+	withProject := base
+	withProject.ProjectID = "p1"
+	withInviter := base
+	withInviter.Inviter = "carol"
+
+	tests := []struct {
+		name string
+		req  RunPrivacyRequest
+		inv  *pb.ProjectInvitation
+		want bool
+	}{
+		{"from partner", base, invitation("p1", "alice", "bob", pb.InvitationStatus_UNDECIDED), true},
+		{"invitee empty", base, invitation("p1", "alice", "", pb.InvitationStatus_UNDECIDED), true},
+		{"from stranger", base, invitation("p1", "dave", "bob", pb.InvitationStatus_UNDECIDED), false},
+		{"for other invitee", base, invitation("p1", "alice", "carol", pb.InvitationStatus_UNDECIDED), false},
+		{"declined", base, invitation("p1", "alice", "bob", pb.InvitationStatus_DECLINED), false},
+		// 没有指定项目时不能认领其他任务已接受的邀请
+		{"accepted without project", base, invitation("p1", "alice", "bob", pb.InvitationStatus_ACCEPTED), false},
+		{"accepted with project", withProject, invitation("p1", "alice", "bob", pb.InvitationStatus_ACCEPTED), true},
+		{"other project", withProject, invitation("p2", "alice", "bob", pb.InvitationStatus_UNDECIDED), false},
+		{"expected inviter", withInviter, invitation("p1", "carol", "bob", pb.InvitationStatus_UNDECIDED), true},
+		{"other partner than inviter", withInviter, invitation("p1", "alice", "bob", pb.InvitationStatus_UNDECIDED), false},
+	}
+	for _, tt := range tests {
+		if got := tt.req.matchInvitation(tt.inv); got != tt.want {
+			t.Errorf("%s: matchInvitation = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateInvitation(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     RunPrivacyRequest
+		wantErr bool
+	}{
+		{"defaults", RunPrivacyRequest{Parties: []Party{{User: "alice"}}}, false},
+		{"inviter is partner", RunPrivacyRequest{Parties: []Party{{User: "alice"}}, Inviter: "alice"}, false},
+		{"inviter not partner", RunPrivacyRequest{Parties: []Party{{User: "alice"}}, Inviter: "dave"}, true},
+		{"reject unmatched", RunPrivacyRequest{Parties: []Party{{User: "alice"}}, UnmatchedInvitations: UnmatchedReject}, false},
+		{"unknown unmatched action", RunPrivacyRequest{Parties: []Party{{User: "alice"}}, UnmatchedInvitations: "accept"}, true},
+	}
+	for _, tt := range tests {
+		if err := validateInvitation(&tt.req); (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -6,13 +6,13 @@ import (
 	"runtime/debug"
 
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/secretflow/scql/pkg/util/brokerutil"
 	log "github.com/sirupsen/logrus"
 )
 
 // 初始化函数：设置日志的输出目标和格式
 func init() {
-	brokerCommand = brokerutil.NewCommand("http://127.0.0.1:8080", 30)
+	brokerCommand = newBrokerClient("http://127.0.0.1:8080", 30)
+	taskStore = NewTaskStore()
 
 	file, err := os.OpenFile("tsqlctl.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
@@ -27,6 +27,8 @@ func init() {
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp: true,
 	})
+
+	initTaskQueue()
 }
 
 func main() {
@@ -36,8 +38,27 @@ func main() {
 		}
 	}()
 
+	go recoverInterruptedTasks()
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/privacy/run", runPrivacyHandler)
+	mux.HandleFunc("GET /api/privacy/tasks/{id}", getTaskHandler)
+	mux.HandleFunc("GET /api/privacy/tasks/{id}/dataset", getTaskDatasetHandler)
+	mux.HandleFunc("GET /api/privacy/tasks/{id}/result", getTaskResultHandler)
+	mux.HandleFunc("GET /api/privacy/tasks/{id}/ccl", getTaskCCLHandler)
+	mux.HandleFunc("POST /api/privacy/tasks/{id}/queries", runQueriesHandler)
+	mux.HandleFunc("GET /api/privacy/jobs/{job_id}/result", getJobResultHandler)
+	mux.HandleFunc("POST /api/privacy/tasks/{id}/resume", resumeTaskHandler)
+	mux.HandleFunc("POST /api/privacy/tasks/{id}/cancel", cancelTaskHandler)
+	mux.HandleFunc("POST /api/privacy/tasks/{id}/cleanup", cleanupTaskHandler)
+	mux.HandleFunc("GET /api/privacy/tasks/{id}/events", taskEventsHandler)
+	mux.HandleFunc("GET /api/privacy/projects", listProjectsHandler)
+	mux.HandleFunc("GET /api/privacy/projects/{id}", getProjectHandler)
+	mux.HandleFunc("POST /api/privacy/projects/{id}/archive", archiveProjectHandler)
+	mux.HandleFunc("DELETE /api/privacy/projects/{id}/tables/{table}", dropProjectTableHandler)
+
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.HandleFunc("GET /readyz", readyzHandler)
 
 	log.Println("privacy service listening on :8000")
 	log.Fatal(http.ListenAndServe(":8000", mux))
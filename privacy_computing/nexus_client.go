@@ -5,22 +5,33 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type ReadRequest struct {
-	JSONRPC string     `json:"jsonrpc"`
-	Method  string     `json:"method"`
-	Params  ReadParams `json:"params"`
-	ID      int64      `json:"id"`
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+	ID      int64  `json:"id"`
 }
 
 type ReadParams struct {
 	Path string `json:"path"`
 }
 
+// read_range 读取 [Start, End) 字节
+type ReadRangeParams struct {
+	Path  string `json:"path"`
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+}
+
 type ReadResponse struct {
 	JSONRPC string      `json:"jsonrpc"`
 	ID      int64       `json:"id"`
@@ -38,6 +49,19 @@ type RPCError struct {
 	Message string `json:"message"`
 }
 
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// JSON-RPC 方法不存在
+const rpcMethodNotFound = -32601
+
+// Nexus 的文件不存在错误（FILE_NOT_FOUND）
+const rpcFileNotFound = -32000
+
+// 分块读取时每块的大小，内存占用不超过一块（及其 base64 编码）
+const nexusChunkSize = 8 << 20
+
 type WriteRequest struct {
 	JSONRPC string      `json:"jsonrpc"`
 	Method  string      `json:"method"`
@@ -77,20 +101,74 @@ func NewClient(baseURL, auth string) *Client {
 	return &Client{
 		BaseURL: baseURL,
 		Auth:    auth,
+		// 大文件分块读取，超时针对单次请求
 		Client: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout: 2 * time.Minute,
 		},
 	}
 }
 
 func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return c.read(ctx, "read", ReadParams{Path: path})
+}
+
+// 分块读取文件并写入 w，每块写入后以累计字节数调用 progress；
+// 服务端不支持 read_range 时退回整体读取
+func (c *Client) ReadFileTo(ctx context.Context, path string, w io.Writer, progress func(written int64)) (int64, error) {
+	var written int64
+	for {
+		data, err := c.read(ctx, "read_range", ReadRangeParams{Path: path, Start: written, End: written + nexusChunkSize})
+		var rpcErr *RPCError
+		if written == 0 && errors.As(err, &rpcErr) && rpcErr.Code == rpcMethodNotFound {
+			log.Warnf("nexus read_range not supported, read %s at once", path)
+			if data, err = c.ReadFile(ctx, path); err != nil {
+				return 0, err
+			}
+			n, err := w.Write(data)
+			progress(int64(n))
+			return int64(n), err
+		}
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		progress(written)
+		if len(data) < nexusChunkSize {
+			return written, nil
+		}
+	}
+}
+
+// 解码 JSON-RPC 响应。方法在 URL 中，服务端没有该方法时可能直接返回非 JSON 的 HTTP 404/405，
+// 此时返回 rpcMethodNotFound；其余非 200 响应返回响应中的 JSON-RPC 错误或 HTTP 状态
+func decodeRPCResponse(resp *http.Response, method string, v any) error {
+	if resp.StatusCode == http.StatusOK {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var rpcResp struct {
+		Error *RPCError `json:"error"`
+	}
+	if json.Unmarshal(body, &rpcResp) == nil && rpcResp.Error != nil {
+		return rpcResp.Error
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		return &RPCError{Code: rpcMethodNotFound, Message: fmt.Sprintf("%s: %s", method, resp.Status)}
+	}
+	return fmt.Errorf("%s: %s: %s", method, resp.Status, bytes.TrimSpace(body))
+}
+
+// 调用 read / read_range，返回解码后的数据
+func (c *Client) read(ctx context.Context, method string, params any) ([]byte, error) {
 	reqBody := ReadRequest{
 		JSONRPC: "2.0",
-		Method:  "read",
-		Params: ReadParams{
-			Path: path,
-		},
-		ID: time.Now().UnixNano(),
+		Method:  method,
+		Params:  params,
+		ID:      time.Now().UnixNano(),
 	}
 
 	bodyBytes, err := json.Marshal(reqBody)
@@ -101,7 +179,7 @@ func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
 	req, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodPost,
-		c.BaseURL+"/api/nfs/read", //http://124.223.11.17:8080/api/nfs/read
+		c.BaseURL+"/api/nfs/"+method, //http://124.223.11.17:8080/api/nfs/read
 		bytes.NewReader(bodyBytes),
 	)
 	if err != nil {
@@ -118,15 +196,12 @@ func (c *Client) ReadFile(ctx context.Context, path string) ([]byte, error) {
 	defer resp.Body.Close()
 
 	var rpcResp ReadResponse
-	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+	if err := decodeRPCResponse(resp, method, &rpcResp); err != nil {
 		return nil, err
 	}
 
 	if rpcResp.Error != nil {
-		return nil, fmt.Errorf("rpc error %d: %s",
-			rpcResp.Error.Code,
-			rpcResp.Error.Message,
-		)
+		return nil, rpcResp.Error
 	}
 
 	if rpcResp.Result == nil {
@@ -207,3 +282,69 @@ func (c *Client) WriteFile(
 
 	return rpcResp.Result, nil
 }
+
+type ExistsResponse struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int64  `json:"id"`
+	Result  *struct {
+		Exists bool `json:"exists"`
+	} `json:"result,omitempty"`
+	Error *RPCError `json:"error,omitempty"`
+}
+
+// 文件是否存在；服务端不支持 exists 时尝试读取第一个字节
+func (c *Client) Exists(ctx context.Context, path string) (bool, error) {
+	bodyBytes, err := json.Marshal(ReadRequest{
+		JSONRPC: "2.0",
+		Method:  "exists",
+		Params:  ReadParams{Path: path},
+		ID:      time.Now().UnixNano(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/api/nfs/exists", bytes.NewReader(bodyBytes))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.Auth)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var rpcResp ExistsResponse
+	err = decodeRPCResponse(resp, "exists", &rpcResp)
+	var rpcErr *RPCError
+	if (errors.As(err, &rpcErr) && rpcErr.Code == rpcMethodNotFound) || (rpcResp.Error != nil && rpcResp.Error.Code == rpcMethodNotFound) {
+		return c.probe(ctx, path)
+	}
+	if err != nil {
+		return false, err
+	}
+	if rpcResp.Error != nil {
+		return false, rpcResp.Error
+	}
+	if rpcResp.Result == nil {
+		return false, fmt.Errorf("empty exists result")
+	}
+	return rpcResp.Result.Exists, nil
+}
+
+// 读取文件的第一个字节判断是否存在，只有文件不存在的错误视为不存在，其余错误（如无权限）返回错误；
+// 服务端也不支持 read_range 时读取整个文件
+func (c *Client) probe(ctx context.Context, path string) (bool, error) {
+	_, err := c.read(ctx, "read_range", ReadRangeParams{Path: path, Start: 0, End: 1})
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == rpcMethodNotFound {
+		_, err = c.ReadFile(ctx, path)
+	}
+	if errors.As(err, &rpcErr) && rpcErr.Code == rpcFileNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+	log "github.com/sirupsen/logrus"
+)
+
+// 项目概况
+type ProjectInfo struct {
+	ProjectID string     `json:"project_id"`
+	Creator   string     `json:"creator"`
+	Members   []string   `json:"members"`
+	Archived  bool       `json:"archived"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// 项目中的表
+type ProjectTable struct {
+	Name     string `json:"name"`
+	Owner    string `json:"owner"`
+	RefTable string `json:"ref_table"`
+	DBType   string `json:"db_type"`
+	Columns  []struct {
+		Name  string `json:"name"`
+		Dtype string `json:"dtype"`
+	} `json:"columns"`
+}
+
+// 项目详情：成员、表和 CCL
+type ProjectDetail struct {
+	ProjectInfo
+	Tables []ProjectTable `json:"tables"`
+	CCL    []CCLGrant     `json:"ccl"`
+}
+
+func projectInfo(p *pb.ProjectDesc) ProjectInfo {
+	info := ProjectInfo{
+		ProjectID: p.GetProjectId(),
+		Creator:   p.GetCreator(),
+		Members:   p.GetMembers(),
+		Archived:  p.GetArchived(),
+	}
+	if p.GetCreatedAt() != nil {
+		t := p.GetCreatedAt().AsTime()
+		info.CreatedAt = &t
+	}
+	return info
+}
+
+// 列出项目，projectID 非空时只查询该项目
+func listProjects(ctx context.Context, projectID string) ([]ProjectInfo, error) {
+	response, err := brokerCall(ctx, func() (*pb.ListProjectsResponse, error) {
+		return brokerCommand.GetProject(projectID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	projects := []ProjectInfo{}
+	for _, p := range response.GetProjects() {
+		projects = append(projects, projectInfo(p))
+	}
+	return projects, nil
+}
+
+// 查询项目，不存在时返回 nil
+func getProject(ctx context.Context, projectID string) (*ProjectInfo, error) {
+	projects, err := listProjects(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range projects {
+		if p.ProjectID == projectID {
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+// 项目中的表，names 为空时返回全部
+func listTables(ctx context.Context, projectID string, names ...string) ([]ProjectTable, error) {
+	response, err := brokerCall(ctx, func() (*pb.ListTablesResponse, error) {
+		return brokerCommand.GetTable(projectID, names)
+	})
+	if err != nil {
+		return nil, err
+	}
+	tables := []ProjectTable{}
+	for _, t := range response.GetTables() {
+		table := ProjectTable{
+			Name:     t.GetTableName(),
+			Owner:    t.GetTableOwner(),
+			RefTable: t.GetRefTable(),
+			DBType:   t.GetDbType(),
+		}
+		for _, c := range t.GetColumns() {
+			table.Columns = append(table.Columns, struct {
+				Name  string `json:"name"`
+				Dtype string `json:"dtype"`
+			}{c.GetName(), c.GetDtype()})
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func archiveProject(ctx context.Context, projectID string) error {
+	_, err := brokerCall(ctx, func() (string, error) {
+		return brokerCommand.ArchiveProject(projectID)
+	})
+	return err
+}
+
+// 撤销本方的表 table 上的所有 CCL 并删除该表，表不存在时不做处理；返回是否删除了表
+func dropProjectTable(ctx context.Context, projectID, table string) (bool, error) {
+	tables, err := listTables(ctx, projectID, table)
+	if err != nil {
+		return false, err
+	}
+	if !slices.ContainsFunc(tables, func(t ProjectTable) bool { return t.Name == table }) {
+		return false, nil
+	}
+	ccls, err := currentCCL(ctx, projectID, table)
+	if err != nil {
+		return false, err
+	}
+	byParty := make(map[string][]*pb.ColumnControl)
+	for _, g := range ccls {
+		byParty[g.Party] = append(byParty[g.Party], &pb.ColumnControl{
+			Col:        &pb.ColumnDef{ColumnName: g.Column, TableName: g.Table},
+			PartyCode:  g.Party,
+			Constraint: pb.Constraint(pb.Constraint_value[g.Constraint]),
+		})
+	}
+	for party, list := range byParty {
+		err := brokerExec(ctx, func() error {
+			return brokerCommand.RevokeCCL(projectID, list)
+		})
+		if err != nil {
+			return false, fmt.Errorf("revoke ccl of %s: %w", party, err)
+		}
+	}
+	err = brokerExec(ctx, func() error {
+		return brokerCommand.DeleteTable(projectID, table)
+	})
+	return err == nil, err
+}
+
+// 列出 broker 中的项目
+func listProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	projects, err := listProjects(r.Context(), "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+// 查询项目的成员、表和 CCL
+func getProjectHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := r.PathValue("id")
+	project, err := getProject(r.Context(), projectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if project == nil {
+		http.Error(w, "project not found", http.StatusNotFound)
+		return
+	}
+	detail := ProjectDetail{ProjectInfo: *project}
+	if detail.Tables, err = listTables(r.Context(), projectID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if detail.CCL, err = currentCCL(r.Context(), projectID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// 归档项目，归档后不能再执行查询
+func archiveProjectHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := r.PathValue("id")
+	project, err := getProject(r.Context(), projectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if project == nil {
+		http.Error(w, "project not found", http.StatusNotFound)
+		return
+	}
+	if !project.Archived {
+		if err := archiveProject(r.Context(), projectID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Infof("project %s archived", projectID)
+		project.Archived = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+// 撤销 CCL 并删除本方在项目中的表
+func dropProjectTableHandler(w http.ResponseWriter, r *http.Request) {
+	projectID, table := r.PathValue("id"), r.PathValue("table")
+	dropped, err := dropProjectTable(r.Context(), projectID, table)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if !dropped {
+		http.Error(w, "table not found", http.StatusNotFound)
+		return
+	}
+	log.Infof("table %s of project %s dropped", table, projectID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 任务结束后的清理结果
+type TaskCleanupResponse struct {
+	TaskID string `json:"task_id"`
+	// 已执行的操作：drop_project_table / archive_project / drop_mysql_table / remove_work_dir
+	Actions []string `json:"actions"`
+}
+
+// 清理已结束的任务：撤销 CCL 并删除本方在项目中的表，发起方归档项目，删除 MySQL 表和任务目录；
+// 清理后任务不能再恢复执行，也不能在其项目上执行查询。archive=false 时不归档项目
+func cleanupTaskHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := taskStore.Get(r.PathValue("id"))
+	if err == ErrTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !rec.Phase.IsTerminal() || rec.Request == nil {
+		http.Error(w, fmt.Sprintf("task in phase %s can not be cleaned up", rec.Phase), http.StatusConflict)
+		return
+	}
+	if isTaskRunning(rec.ID) {
+		http.Error(w, "task is still running", http.StatusConflict)
+		return
+	}
+	if err := checkQueryTasks(rec); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	actions, err := cleanupTask(r.Context(), rec, r.URL.Query().Get("archive") != "false")
+	var be *BrokerError
+	if errors.As(err, &be) {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TaskCleanupResponse{TaskID: rec.ID, Actions: actions})
+}
+
+// 在任务的项目上执行查询的任务都已结束时才能清理，否则会中断这些查询
+func checkQueryTasks(rec *TaskRecord) error {
+	for _, id := range rec.QueryTasks {
+		child, err := taskStore.Get(id)
+		if err == ErrTaskNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !child.Phase.IsTerminal() || isTaskRunning(child.ID) {
+			return fmt.Errorf("query task %s on the project is in phase %s", child.ID, child.Phase)
+		}
+	}
+	return nil
+}
+
+// 执行清理，返回已执行的操作；broker 调用失败时返回 *BrokerError
+func cleanupTask(ctx context.Context, rec *TaskRecord, archive bool) ([]string, error) {
+	actions := []string{}
+	// 在已有项目上执行查询的任务只有任务目录；项目已删除（如取消时）则跳过
+	var project *ProjectInfo
+	var err error
+	if rec.BaseTaskID == "" && rec.ProjectID != "" {
+		if project, err = getProject(ctx, rec.ProjectID); err != nil {
+			return actions, fmt.Errorf("get project: %w", err)
+		}
+	}
+	if project != nil {
+		dropped, err := dropProjectTable(ctx, rec.ProjectID, rec.Request.User)
+		if err != nil {
+			return actions, fmt.Errorf("drop project table: %w", err)
+		}
+		if dropped {
+			actions = append(actions, "drop_project_table")
+		}
+		if rec.Request.RunSQL != "" && !project.Archived && archive {
+			if err := archiveProject(ctx, rec.ProjectID); err != nil {
+				return actions, fmt.Errorf("archive project: %w", err)
+			}
+			actions = append(actions, "archive_project")
+		}
+	}
+	if rec.BaseTaskID == "" && rec.Table != "" {
+		db, err := GetDB(dsn)
+		var table string
+		if err == nil {
+			table, err = quoteIdent(rec.Table)
+		}
+		if err == nil {
+			err = ExecSQLContext(ctx, db, fmt.Sprintf("drop table IF EXISTS %s", table))
+		}
+		if err != nil {
+			return actions, fmt.Errorf("drop mysql table: %w", err)
+		}
+		actions = append(actions, "drop_mysql_table")
+	}
+	if err := os.RemoveAll(newTaskRunner(rec).workDir); err != nil {
+		return actions, fmt.Errorf("remove work dir: %w", err)
+	}
+	actions = append(actions, "remove_work_dir")
+
+	now := time.Now()
+	updateTask(rec.ID, func(rec *TaskRecord) {
+		rec.CleanedAt = &now
+	})
+	log.Infof("[task=%s] cleaned up: %v", rec.ID, actions)
+	return actions, nil
+}
+
+// auto_cleanup：任务成功后自动清理，失败时只记录日志，可再手动清理
+func (t *taskRunner) autoCleanup() {
+	// 任务的 ctx 可能已接近全局超时，清理使用单独的超时
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	rec, err := taskStore.Get(t.taskID)
+	if err == nil {
+		err = checkQueryTasks(rec)
+	}
+	if err == nil {
+		_, err = cleanupTask(ctx, rec, true)
+	}
+	if err != nil {
+		log.Errorf("[task=%s] auto cleanup err:%s", t.taskID, err.Error())
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+	"github.com/secretflow/scql/pkg/proto-gen/spu"
+	"github.com/secretflow/scql/pkg/util/message"
+)
+
+// 项目配置，对应 SCQL 的 ProjectConfig 和查询的 JobConfig，未设置的字段使用默认值
+type ProjectConfig struct {
+	// SPU 协议：SEMI2K（默认）、CHEETAH（仅两方）、ABY3（仅三方）
+	Protocol string `json:"protocol,omitempty"`
+	// 环大小：FM32、FM64（默认）、FM128
+	Field string `json:"field,omitempty"`
+	// 定点数小数位数，0 表示使用 SPU 默认值
+	FxpFractionBits int64 `json:"fxp_fraction_bits,omitempty"`
+	// 会话过期时间（秒），默认 86400
+	SessionExpireSeconds int64 `json:"session_expire_seconds,omitempty"`
+
+	// PSI 曲线：CURVE_25519、CURVE_FOURQ、CURVE_SM2、CURVE_SECP256K1，为空时由 engine 决定
+	PsiCurveType string `json:"psi_curve_type,omitempty"`
+	// PSI 算法：AUTO（默认）、ECDH、OPRF、RR22
+	PsiType string `json:"psi_type,omitempty"`
+
+	// 参与方之间的连接参数，0 表示使用 engine 默认值
+	LinkRecvTimeoutSec          int64 `json:"link_recv_timeout_sec,omitempty"`
+	LinkThrottleWindowSize      int64 `json:"link_throttle_window_size,omitempty"`
+	LinkChunkedSendParallelSize int64 `json:"link_chunked_send_parallel_size,omitempty"`
+	HttpMaxPayloadSize          int64 `json:"http_max_payload_size,omitempty"`
+}
+
+const defaultSessionExpireSeconds = 86400
+
+// SPU 协议支持的参与方数量（0 表示不限制）和环大小
+var spuProtocols = map[string]struct {
+	parties int
+	fields  []string
+}{
+	"SEMI2K":  {0, []string{"FM32", "FM64", "FM128"}},
+	"CHEETAH": {2, []string{"FM64", "FM128"}},
+	"ABY3":    {3, []string{"FM64", "FM128"}},
+}
+
+// 环大小对应的位数，小数位数不能超过一半
+var fieldBits = map[string]int64{
+	"FM32":  32,
+	"FM64":  64,
+	"FM128": 128,
+}
+
+// 与 psi 库的 CurveType 取值一致
+var psiCurveTypes = map[string]int32{
+	"CURVE_25519":     1,
+	"CURVE_FOURQ":     2,
+	"CURVE_SM2":       3,
+	"CURVE_SECP256K1": 4,
+}
+
+// 请求中的项目配置，兼容只设置了 spu_protocol 的旧请求
+func (req *RunPrivacyRequest) projectConfig() ProjectConfig {
+	var conf ProjectConfig
+	if req.ProjectConf != nil {
+		conf = *req.ProjectConf
+	}
+	if conf.Protocol == "" {
+		conf.Protocol = req.SpuProtocol
+	}
+	return conf.withDefaults()
+}
+
+func (c ProjectConfig) withDefaults() ProjectConfig {
+	c.Protocol = strings.ToUpper(c.Protocol)
+	if c.Protocol == "" {
+		c.Protocol = "SEMI2K"
+	}
+	c.Field = strings.ToUpper(c.Field)
+	if c.Field == "" {
+		c.Field = "FM64"
+	}
+	if c.SessionExpireSeconds == 0 {
+		c.SessionExpireSeconds = defaultSessionExpireSeconds
+	}
+	c.PsiCurveType = strings.ToUpper(c.PsiCurveType)
+	c.PsiType = strings.ToUpper(c.PsiType)
+	if c.PsiType == "" {
+		c.PsiType = "AUTO"
+	}
+	return c
+}
+
+// 校验配置是否为 broker 支持的组合，parties 为参与方数量（含本节点）
+func (c ProjectConfig) Validate(parties int) error {
+	protocol, ok := spuProtocols[c.Protocol]
+	if !ok {
+		return fmt.Errorf("not support spu protocol %v", c.Protocol)
+	}
+	if protocol.parties > 0 && parties != protocol.parties {
+		return fmt.Errorf("spu protocol %s requires %d parties, got %d", c.Protocol, protocol.parties, parties)
+	}
+	if _, ok := fieldBits[c.Field]; !ok {
+		return fmt.Errorf("not support field %v", c.Field)
+	}
+	supported := false
+	for _, field := range protocol.fields {
+		supported = supported || field == c.Field
+	}
+	if !supported {
+		return fmt.Errorf("spu protocol %s does not support field %s", c.Protocol, c.Field)
+	}
+	if c.FxpFractionBits < 0 || c.FxpFractionBits >= fieldBits[c.Field]/2 {
+		return fmt.Errorf("fxp_fraction_bits must be in [0, %d) for field %s", fieldBits[c.Field]/2, c.Field)
+	}
+	if c.SessionExpireSeconds < 0 {
+		return fmt.Errorf("session_expire_seconds must not be negative")
+	}
+	if _, ok := psiCurveTypes[c.PsiCurveType]; c.PsiCurveType != "" && !ok {
+		return fmt.Errorf("not support psi curve type %v", c.PsiCurveType)
+	}
+	if _, ok := pb.PsiAlgorithmType_value[c.PsiType]; !ok {
+		return fmt.Errorf("not support psi type %v", c.PsiType)
+	}
+	for name, v := range map[string]int64{
+		"link_recv_timeout_sec":           c.LinkRecvTimeoutSec,
+		"link_throttle_window_size":       c.LinkThrottleWindowSize,
+		"link_chunked_send_parallel_size": c.LinkChunkedSendParallelSize,
+		"http_max_payload_size":           c.HttpMaxPayloadSize,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// 创建项目时使用的 ProjectConfig（JSON）
+func (c ProjectConfig) projectConf() (string, error) {
+	conf, err := message.ProtoMarshal(&pb.ProjectConfig{
+		SpuRuntimeCfg: &spu.RuntimeConfig{
+			Protocol:        spu.ProtocolKind(spu.ProtocolKind_value[c.Protocol]),
+			Field:           spu.FieldType(spu.FieldType_value[c.Field]),
+			FxpFractionBits: c.FxpFractionBits,
+		},
+		SessionExpireSeconds:        c.SessionExpireSeconds,
+		PsiCurveType:                psiCurveTypes[c.PsiCurveType],
+		HttpMaxPayloadSize:          c.HttpMaxPayloadSize,
+		LinkRecvTimeoutSec:          c.LinkRecvTimeoutSec,
+		LinkThrottleWindowSize:      c.LinkThrottleWindowSize,
+		LinkChunkedSendParallelSize: c.LinkChunkedSendParallelSize,
+	})
+	return string(conf), err
+}
+
+// 执行查询时使用的 JobConfig（JSON），未设置的连接参数沿用项目配置
+func (c ProjectConfig) jobConf() (string, error) {
+	conf, err := message.ProtoMarshal(&pb.JobConfig{
+		PsiType: pb.PsiAlgorithmType(pb.PsiAlgorithmType_value[c.PsiType]),
+	})
+	return string(conf), err
+}
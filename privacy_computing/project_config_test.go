@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProjectConfigDefaults(t *testing.T) {
+	req := &RunPrivacyRequest{SpuProtocol: "cheetah", ProjectConf: &ProjectConfig{Field: "fm128", PsiType: "ecdh"}}
+	got := req.projectConfig()
+	want := ProjectConfig{Protocol: "CHEETAH", Field: "FM128", SessionExpireSeconds: defaultSessionExpireSeconds, PsiType: "ECDH"}
+	if got != want {
+		t.Errorf("projectConfig = %+v, want %+v", got, want)
+	}
+
+	got = (&RunPrivacyRequest{}).projectConfig()
+	want = ProjectConfig{Protocol: "SEMI2K", Field: "FM64", SessionExpireSeconds: defaultSessionExpireSeconds, PsiType: "AUTO"}
+	if got != want {
+		t.Errorf("default projectConfig = %+v, want %+v", got, want)
+	}
+
+	// project_conf.protocol 优先于 spu_protocol
+	req = &RunPrivacyRequest{SpuProtocol: "CHEETAH", ProjectConf: &ProjectConfig{Protocol: "ABY3"}}
+	if got := req.projectConfig().Protocol; got != "ABY3" {
+		t.Errorf("protocol = %s, want ABY3", got)
+	}
+}
+
+func TestProjectConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    ProjectConfig
+		parties int
+		wantErr string
+	}{
+		{"defaults", ProjectConfig{}, 3, ""},
+		{"cheetah two parties", ProjectConfig{Protocol: "CHEETAH"}, 2, ""},
+		{"cheetah three parties", ProjectConfig{Protocol: "CHEETAH"}, 3, "requires 2 parties"},
+		{"aby3 three parties", ProjectConfig{Protocol: "ABY3", Field: "FM128"}, 3, ""},
+		{"aby3 two parties", ProjectConfig{Protocol: "ABY3"}, 2, "requires 3 parties"},
+		{"unknown protocol", ProjectConfig{Protocol: "REF2K"}, 2, "not support spu protocol"},
+		{"unknown field", ProjectConfig{Field: "FM16"}, 2, "not support field"},
+		{"field not supported by protocol", ProjectConfig{Protocol: "CHEETAH", Field: "FM32"}, 2, "does not support field"},
+		{"fraction bits at limit", ProjectConfig{Field: "FM64", FxpFractionBits: 31}, 2, ""},
+		{"fraction bits too large", ProjectConfig{Field: "FM64", FxpFractionBits: 32}, 2, "fxp_fraction_bits"},
+		{"negative fraction bits", ProjectConfig{FxpFractionBits: -1}, 2, "fxp_fraction_bits"},
+		{"negative session expire", ProjectConfig{SessionExpireSeconds: -1}, 2, "session_expire_seconds"},
+		{"psi curve", ProjectConfig{PsiCurveType: "curve_sm2"}, 2, ""},
+		{"unknown psi curve", ProjectConfig{PsiCurveType: "CURVE_X"}, 2, "psi curve type"},
+		{"psi type", ProjectConfig{PsiType: "rr22"}, 2, ""},
+		{"unknown psi type", ProjectConfig{PsiType: "KKRT"}, 2, "psi type"},
+		{"negative link option", ProjectConfig{LinkRecvTimeoutSec: -1}, 2, "link_recv_timeout_sec"},
+	}
+	for _, tt := range tests {
+		err := tt.conf.withDefaults().Validate(tt.parties)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+	log "github.com/sirupsen/logrus"
+)
+
+// 查询方式
+const (
+	QueryModeAsync = "async" // 提交作业后轮询结果（默认）
+	QueryModeSync  = "sync"  // 同步执行，受 broker 客户端 30 秒超时限制
+)
+
+// 提交作业和获取结果连续失败的最多次数
+const queryAttempts = 30
+
+// 作业执行状态
+type QueryJobStatus struct {
+	Summary        string    `json:"summary,omitempty"`
+	StagesCount    int32     `json:"stages_count,omitempty"`
+	ExecutedStages int32     `json:"executed_stages,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func (req *RunPrivacyRequest) queryMode() string {
+	if req.QueryMode == "" {
+		return QueryModeAsync
+	}
+	return strings.ToLower(req.QueryMode)
+}
+
+func validateQueryMode(mode string) error {
+	switch strings.ToLower(mode) {
+	case "", QueryModeAsync, QueryModeSync:
+		return nil
+	}
+	return fmt.Errorf("not support query mode %v", mode)
+}
+
+// 轮询结果的间隔，环境变量 QUERY_POLL_INTERVAL（秒），默认 5 秒
+func queryPollInterval() time.Duration {
+	if v, err := strconv.Atoi(os.Getenv("QUERY_POLL_INTERVAL")); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// 提交查询作业，返回作业 ID；jobID 为空时由 broker 生成
+func submitQuery(ctx context.Context, projectID, jobID, query, jobConf string) (string, error) {
+	return brokerCall(ctx, func() (string, error) {
+		return brokerCommand.CreateJob(projectID, jobID, query, &pb.DebugOptions{EnablePsiDetailLog: false}, jobConf)
+	})
+}
+
+// 获取作业结果，作业未完成时 Status.Code 为 NOT_READY
+func fetchResult(ctx context.Context, jobID string) (*pb.FetchResultResponse, error) {
+	return brokerCall(ctx, func() (*pb.FetchResultResponse, error) {
+		return brokerCommand.GetResult(jobID)
+	})
+}
+
+func cancelQuery(ctx context.Context, jobID string) error {
+	return brokerExec(ctx, func() error {
+		return brokerCommand.CancelJob(jobID)
+	})
+}
+
+// broker 返回了作业的错误状态（执行失败、作业不存在或结果已过期），而不是调用失败
+func isJobFailed(err error) bool {
+	var be *BrokerError
+	return errors.As(err, &be) && be.Responded()
+}
+
+func jobStatus(s *pb.JobStatus) *QueryJobStatus {
+	status := &QueryJobStatus{Summary: s.GetSummary(), UpdatedAt: time.Now()}
+	if p := s.GetProgress(); p != nil {
+		status.StagesCount = p.StagesCount
+		status.ExecutedStages = p.ExecutedStages
+	}
+	return status
+}
+
+// 异步执行第 i 条查询：提交作业并记录作业 ID，轮询直到结果可用后写入 resultFile；
+// 恢复执行时已有作业 ID 则继续轮询该作业
+func (t *taskRunner) queryAsync(ctx context.Context, i int, jobID, sql, resultFile, jobConf string) (int64, error) {
+	t.jobID = jobID
+	if jobID == "" {
+		err := t.withRetry(ctx, RetryRunQuery, fmt.Sprintf("submitQuery %d", i+1), func(attempt int) error {
+			var jobID string
+			t.updateQuery(i, func(q *QueryRecord) {
+				q.Attempts = attempt
+				// 结果共享时使用接收方可推算的作业 ID，接收方据此等待作业完成
+				if t.req.sharesResult() {
+					q.Submits++
+					jobID = sharedJobID(t.projectID, i, q.Submits)
+				}
+			})
+			jobID, err := submitQuery(ctx, t.projectID, jobID, sql, jobConf)
+			if err != nil {
+				updateTask(t.taskID, func(rec *TaskRecord) {
+					rec.LastError = err.Error()
+				})
+				return err
+			}
+			t.setJob(i, jobID)
+			emitEvent(t.taskID, EventJob, map[string]any{"index": i, "job_id": jobID}, "query job %s submitted", jobID)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// 获取结果按轮询间隔进行，连续失败的次数受 run_query 的 max_attempts 限制
+	maxFailures := t.req.retryConfig(RetryRunQuery).MaxAttempts
+	fetchName := fmt.Sprintf("fetchResult %d", i+1)
+	failures := 0
+	for {
+		resp, err := fetchResult(ctx, t.jobID)
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return 0, waitErr(ctx, err)
+		case err != nil && isJobFailed(err):
+			// 恢复执行时重新提交
+			jobID := t.jobID
+			t.setJob(i, "")
+			return 0, fmt.Errorf("query job %s: %w", jobID, err)
+		case err != nil:
+			failures++
+			if maxFailures > 0 && failures >= maxFailures {
+				t.setRetry(fetchName, RetryRunQuery, failures, err, nil)
+				return 0, fmt.Errorf("fetchResult: too many attempts: %w", err)
+			}
+			next := time.Now().Add(queryPollInterval())
+			t.setRetry(fetchName, RetryRunQuery, failures, err, &next)
+			t.retry(fetchName, failures, err, queryPollInterval())
+			updateTask(t.taskID, func(rec *TaskRecord) {
+				rec.LastError = err.Error()
+			})
+		case resp.GetStatus().GetCode() == int32(pb.Code_NOT_READY):
+			failures = 0
+			status := jobStatus(resp.JobStatus)
+			t.updateQuery(i, func(q *QueryRecord) {
+				q.JobStatus = status
+			})
+		default:
+			rows, err := t.saveResult(i, resultFile, resp.GetResult())
+			if err != nil {
+				return 0, err
+			}
+			log.Infof("[task=%s] job %s: %d rows in set (%vs)", t.taskID, t.jobID, rows, resp.GetResult().GetCostTimeS())
+			t.updateQuery(i, func(q *QueryRecord) {
+				q.JobStatus = nil
+			})
+			return rows, nil
+		}
+		if serr := sleepCtx(ctx, queryPollInterval()); serr != nil {
+			return 0, waitErr(ctx, err)
+		}
+	}
+}
+
+// 记录第 i 条查询的作业 ID，用于恢复执行和之后再次获取结果
+func (t *taskRunner) setJob(i int, jobID string) {
+	t.jobID = jobID
+	t.updateQuery(i, func(q *QueryRecord) {
+		q.JobID = jobID
+		q.JobStatus = nil
+	})
+}
+
+// 按作业 ID 再次获取查询结果，格式由 format 参数指定，默认 csv
+func getJobResultHandler(w http.ResponseWriter, r *http.Request) {
+	serveJobResult(w, r, r.PathValue("job_id"), r.URL.Query().Get("format"))
+}
+
+// 获取任务查询作业的结果，格式默认与任务的结果格式相同
+func getTaskResultHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := taskStore.Get(r.PathValue("id"))
+	if err == ErrTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// query 参数为查询序号（从 1 开始），默认为最近执行的查询
+	jobID := rec.JobID
+	if v := r.URL.Query().Get("query"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > len(rec.Queries) {
+			http.Error(w, "invalid query index "+v, http.StatusBadRequest)
+			return
+		}
+		jobID = rec.Queries[n-1].JobID
+	}
+	if jobID == "" {
+		http.Error(w, "task has no query job", http.StatusNotFound)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" && rec.Request != nil {
+		format = rec.Request.resultFormat()
+	}
+	serveJobResult(w, r, jobID, format)
+}
+
+// 作业未完成时返回 202 和作业状态
+func serveJobResult(w http.ResponseWriter, r *http.Request, jobID, format string) {
+	if format == "" {
+		format = FormatCSV
+	}
+	format = strings.ToLower(format)
+	if err := validateResultFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := fetchResult(r.Context(), jobID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.GetStatus().GetCode() == int32(pb.Code_NOT_READY) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]any{
+			"job_id":     jobID,
+			"status":     "running",
+			"job_status": jobStatus(resp.JobStatus),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", resultFormats[format].ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s%s"`, jobID, resultFormats[format].Ext))
+	if _, err := encodeResult(w, format, resp.GetResult().GetOutColumns()); err != nil {
+		log.Errorf("[job=%s] write result err:%s", jobID, err.Error())
+	}
+}
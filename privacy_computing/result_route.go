@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+	log "github.com/sirupsen/logrus"
+)
+
+// 结果上传路径的默认模板，与之前的 <数据目录>/tsql_result_<时间>.csv 相同
+const defaultResultPathTemplate = "{dir}/tsql_result_{timestamp}{ext}"
+
+// 路径模板中可用的占位符
+var resultPathPlaceholders = map[string]bool{
+	"{dir}":       true, // 数据集在 Nexus 中的目录
+	"{user}":      true,
+	"{task_id}":   true,
+	"{project}":   true,
+	"{timestamp}": true, // 上传时间 20060102150405
+	"{index}":     true, // 查询序号，从 1 开始
+	"{ext}":       true, // 结果格式的扩展名，如 .csv
+}
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// 结果的上传位置和接收方
+type ResultConfig struct {
+	// 上传到 Nexus 的路径模板，默认 {dir}/tsql_result_{timestamp}{ext}
+	PathTemplate string `json:"path_template,omitempty"`
+	// 目标文件已存在时是否覆盖，否则在文件名后加 _1、_2 等
+	Overwrite bool `json:"overwrite,omitempty"`
+	// 接收结果的参与方，发起方默认只有本方；协作方包含本方时等待并上传自己的结果
+	Receivers []string `json:"receivers,omitempty"`
+	// 协作方等待接收的结果个数，默认 1
+	Expect int `json:"expect,omitempty"`
+}
+
+// 参与方之间交换结果的本地目录，engine 的 restricted_write_path 需包含该目录，
+// 环境变量 RESULT_SHARE_DIR，默认 /home/user/results
+func resultShareDir() string {
+	if dir := os.Getenv("RESULT_SHARE_DIR"); dir != "" {
+		return dir
+	}
+	return "/home/user/results"
+}
+
+// engine 为各接收方写入的第 i 条查询的结果文件，各参与方路径相同
+func sharedResultFile(projectID string, i int) string {
+	return filepath.Join(resultShareDir(), fmt.Sprintf("%s_result_%d.csv", projectID, i+1))
+}
+
+// 结果共享时第 i 条查询第 n 次提交的作业 ID。作业会分发到各参与方的 broker，
+// 接收方据此从本方 broker 获取作业状态，作业成功即 engine 已写完结果文件
+func sharedJobID(projectID string, i, n int) string {
+	return fmt.Sprintf("%s-r%d-%d", projectID, i+1, n)
+}
+
+// 接收方查找作业时，未找到的作业 ID 之后最多再检查的个数（发起方提交失败时作业 ID 会跳过）
+const sharedJobLookahead = 10
+
+// 接收结果的参与方：发起方默认为本方，协作方默认不接收
+func (req *RunPrivacyRequest) receivers() []string {
+	if req.Result != nil && len(req.Result.Receivers) > 0 {
+		return req.Result.Receivers
+	}
+	if req.RunSQL != "" {
+		return []string{req.User}
+	}
+	return nil
+}
+
+// 本方是否接收结果
+func (req *RunPrivacyRequest) receivesResult() bool {
+	return slices.Contains(req.receivers(), req.User)
+}
+
+// 发起方的结果是否需要交给其他参与方，此时由 engine 以 INTO OUTFILE 写入各接收方
+func (req *RunPrivacyRequest) sharesResult() bool {
+	receivers := req.receivers()
+	return req.RunSQL != "" && (len(receivers) > 1 || (len(receivers) == 1 && receivers[0] != req.User))
+}
+
+func (req *RunPrivacyRequest) expectedResults() int {
+	if req.Result == nil || req.Result.Expect == 0 {
+		return 1
+	}
+	return req.Result.Expect
+}
+
+// 校验路径模板和接收方，需在 RunSQL 规范化和协作方校验之后调用
+func (req *RunPrivacyRequest) validateResult() error {
+	c := req.Result
+	if c == nil {
+		return nil
+	}
+	if c.PathTemplate != "" {
+		if strings.TrimSpace(c.PathTemplate) == "" {
+			return errors.New("result.path_template is empty")
+		}
+		for _, p := range placeholderPattern.FindAllString(c.PathTemplate, -1) {
+			if !resultPathPlaceholders[p] {
+				return fmt.Errorf("result.path_template: unknown placeholder %s", p)
+			}
+		}
+	}
+	if c.Expect < 0 {
+		return errors.New("result.expect must not be negative")
+	}
+	members := map[string]bool{req.User: true}
+	for _, p := range req.partners() {
+		members[p.User] = true
+	}
+	seen := make(map[string]bool)
+	for _, r := range c.Receivers {
+		if !members[r] {
+			return fmt.Errorf("result.receivers: unknown party %s", r)
+		}
+		if seen[r] {
+			return fmt.Errorf("result.receivers: duplicate party %s", r)
+		}
+		// 接收方写入 INTO OUTFILE 子句
+		if _, err := quoteLiteral(r); err != nil {
+			return fmt.Errorf("result.receivers: %w", err)
+		}
+		seen[r] = true
+	}
+	if !req.sharesResult() {
+		return nil
+	}
+	// INTO OUTFILE 只能写 CSV
+	if req.resultFormat() != FormatCSV {
+		return fmt.Errorf("result format %s is not supported when the result is shared with other parties", req.ResultFormat)
+	}
+	// 同步查询的作业 ID 由 broker 生成，接收方无法获取作业状态
+	if req.queryMode() == QueryModeSync {
+		return errors.New("query_mode sync is not supported when the result is shared with other parties")
+	}
+	for i, q := range req.queries() {
+		if strings.Contains(strings.ToUpper(q), "INTO OUTFILE") {
+			return fmt.Errorf("queries[%d]: INTO OUTFILE is not allowed when result.receivers is set", i)
+		}
+	}
+	return nil
+}
+
+// 为各接收方追加 INTO OUTFILE 子句，engine 把结果写入每个接收方的 sharedResultFile
+func (t *taskRunner) routedSQL(i int, sql string) (string, error) {
+	if !t.req.sharesResult() {
+		return sql, nil
+	}
+	var b strings.Builder
+	b.WriteString(strings.TrimRight(strings.TrimSpace(sql), "; \t\r\n"))
+	b.WriteString(" INTO OUTFILE")
+	file, err := quoteLiteral(sharedResultFile(t.projectID, i))
+	if err != nil {
+		return "", fmt.Errorf("result file: %w", err)
+	}
+	for _, party := range t.req.receivers() {
+		code, err := quoteLiteral(party)
+		if err != nil {
+			return "", fmt.Errorf("party code: %w", err)
+		}
+		fmt.Fprintf(&b, " PARTY_CODE %s %s", code, file)
+	}
+	b.WriteString(` FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '"'`)
+	return b.String(), nil
+}
+
+// 保存第 i 条查询的结果，返回行数：结果共享时取本方由 engine 写入的文件，否则按结果格式写入 resultFile
+func (t *taskRunner) saveResult(i int, resultFile string, result *pb.QueryResult) (int64, error) {
+	if !t.req.sharesResult() {
+		if len(result.GetOutColumns()) == 0 {
+			return 0, nil
+		}
+		rows, err := writeResult(resultFile, t.req.resultFormat(), result.GetOutColumns())
+		if err != nil {
+			os.Remove(resultFile)
+			return 0, fmt.Errorf("write result: %w", err)
+		}
+		return rows, nil
+	}
+	if t.req.receivesResult() {
+		if err := moveFile(sharedResultFile(t.projectID, i), resultFile); err != nil {
+			return 0, fmt.Errorf("take shared result: %w", err)
+		}
+	}
+	return result.GetAffectedRows(), nil
+}
+
+// 上传第 i 条查询结果的 Nexus 路径；不覆盖时跳过已存在的文件
+func (t *taskRunner) resultPath(ctx context.Context, i, n int, stamp string) (string, error) {
+	c := t.req.Result
+	tpl := defaultResultPathTemplate
+	if c != nil && c.PathTemplate != "" {
+		tpl = c.PathTemplate
+	}
+	ext := resultFormats[t.req.resultFormat()].Ext
+	path := strings.NewReplacer(
+		"{dir}", filepath.Dir(t.req.Data),
+		"{user}", t.req.User,
+		"{task_id}", t.taskID,
+		"{project}", t.projectID,
+		"{timestamp}", stamp,
+		"{index}", strconv.Itoa(i+1),
+		"{ext}", ext,
+	).Replace(tpl)
+	// 多条查询且模板中没有序号时，在扩展名前加 _<序号>
+	if n > 1 && !strings.Contains(tpl, "{index}") {
+		path = withSuffix(path, ext, fmt.Sprintf("_%d", i+1))
+	}
+	if c != nil && c.Overwrite {
+		return path, nil
+	}
+	for k := 0; ; k++ {
+		candidate := path
+		if k > 0 {
+			candidate = withSuffix(path, ext, fmt.Sprintf("_%d", k))
+		}
+		exists, err := t.client.Exists(ctx, candidate)
+		if err != nil {
+			return "", fmt.Errorf("check %s: %w", candidate, err)
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+}
+
+// 在扩展名 ext 之前插入 suffix，没有该扩展名时加在末尾
+func withSuffix(path, ext, suffix string) string {
+	if ext != "" && strings.HasSuffix(path, ext) {
+		return strings.TrimSuffix(path, ext) + suffix + ext
+	}
+	return path + suffix
+}
+
+// 协作方的 QUERYING：依次等待发起方的查询作业在本方完成，把 engine 写入的 sharedResultFile 移入任务目录
+func (t *taskRunner) receiveResults(ctx context.Context) error {
+	queries, err := t.queries()
+	if err != nil {
+		return err
+	}
+	for i, q := range queries {
+		resultFile := t.resultFile(i)
+		if q.ResultPath != "" || (q.Status == QuerySucceeded && FileExists(resultFile)) {
+			continue
+		}
+		started := time.Now()
+		t.updateQuery(i, func(q *QueryRecord) {
+			q.Status = QueryRunning
+			q.Error = ""
+			q.StartedAt = &started
+			q.FinishedAt = nil
+		})
+		shared := sharedResultFile(t.projectID, i)
+		log.Infof("[task=%s] wait for result %d/%d at %s", t.taskID, i+1, len(queries), shared)
+		jobID, result, err := t.waitSharedJob(ctx, i)
+		if err != nil {
+			return err
+		}
+		if err := moveFile(shared, resultFile); err != nil {
+			return err
+		}
+		// engine 写出的行数，不依赖结果文件是否有表头
+		rows := result.GetAffectedRows()
+		finished := time.Now()
+		t.updateQuery(i, func(q *QueryRecord) {
+			q.Status = QuerySucceeded
+			q.JobID = jobID
+			q.RowCount = rows
+			q.FinishedAt = &finished
+		})
+		emitEvent(t.taskID, EventQuery, map[string]any{"index": i, "status": QuerySucceeded, "row_count": rows, "job_id": jobID},
+			"result %d/%d received", i+1, len(queries))
+	}
+	return nil
+}
+
+// 等待发起方第 i 条查询的作业在本方成功且结果文件存在。作业失败、已过期，或是之前的任务的作业（结果已被取走）时，
+// 检查下一次提交的作业；作业 ID 不存在时还检查之后的几个，发起方提交失败时会跳过作业 ID
+func (t *taskRunner) waitSharedJob(ctx context.Context, i int) (string, *pb.QueryResult, error) {
+	shared := sharedResultFile(t.projectID, i)
+	for n := 1; ; {
+		jobID := sharedJobID(t.projectID, i, n)
+		resp, err := fetchResult(ctx, jobID)
+		if errors.Is(err, ErrNotFound) {
+			if k := t.laterSharedJob(ctx, i, n); k > 0 {
+				n = k
+				continue
+			}
+		}
+		switch {
+		case err != nil && ctx.Err() != nil:
+			return "", nil, waitErr(ctx, err)
+		case errors.Is(err, ErrNotFound):
+			// 尚未提交
+		case err != nil && isJobFailed(err):
+			log.Warnf("[task=%s] job %s: %s", t.taskID, jobID, err.Error())
+			n++
+			continue
+		case err != nil:
+			log.Warnf("[task=%s] fetch job %s: %s", t.taskID, jobID, err.Error())
+		case resp.GetStatus().GetCode() == int32(pb.Code_NOT_READY):
+			t.updateQuery(i, func(q *QueryRecord) {
+				q.JobID = jobID
+				q.JobStatus = jobStatus(resp.JobStatus)
+			})
+		case !FileExists(shared):
+			log.Infof("[task=%s] job %s succeeded but %s does not exist, check the next job", t.taskID, jobID, shared)
+			n++
+			continue
+		default:
+			t.updateQuery(i, func(q *QueryRecord) {
+				q.JobStatus = nil
+			})
+			return jobID, resp.GetResult(), nil
+		}
+		if serr := sleepCtx(ctx, queryPollInterval()); serr != nil {
+			return "", nil, waitErr(ctx, fmt.Errorf("result %d not received", i+1))
+		}
+	}
+}
+
+// 作业 n 不存在时查找之后已提交的作业，返回其序号，没有时返回 0
+func (t *taskRunner) laterSharedJob(ctx context.Context, i, n int) int {
+	for k := n + 1; k <= n+sharedJobLookahead; k++ {
+		_, err := fetchResult(ctx, sharedJobID(t.projectID, i, k))
+		if err == nil || (isJobFailed(err) && !errors.Is(err, ErrNotFound)) {
+			log.Infof("[task=%s] job %s not found, check later job %s", t.taskID, sharedJobID(t.projectID, i, n), sharedJobID(t.projectID, i, k))
+			return k
+		}
+	}
+	return 0
+}
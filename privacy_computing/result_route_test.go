@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateResult(t *testing.T) {
+	base := func(result *ResultConfig) RunPrivacyRequest {
+		return RunPrivacyRequest{User: "alice", Parties: []Party{{User: "bob"}}, RunSQL: "select 1", Result: result}
+	}
+	tests := []struct {
+		name    string
+		req     RunPrivacyRequest
+		wantErr string
+	}{
+		{"no result config", base(nil), ""},
+		{"template", base(&ResultConfig{PathTemplate: "/out/{user}/{task_id}_{index}{ext}"}), ""},
+		{"blank template", base(&ResultConfig{PathTemplate: "  "}), "path_template is empty"},
+		{"unknown placeholder", base(&ResultConfig{PathTemplate: "/out/{date}.csv"}), "unknown placeholder {date}"},
+		{"negative expect", base(&ResultConfig{Expect: -1}), "expect"},
+		{"share with partner", base(&ResultConfig{Receivers: []string{"alice", "bob"}}), ""},
+		{"unknown receiver", base(&ResultConfig{Receivers: []string{"carol"}}), "unknown party carol"},
+		{"duplicate receiver", base(&ResultConfig{Receivers: []string{"bob", "bob"}}), "duplicate party bob"},
+	}
+	for _, tt := range tests {
+		err := tt.req.validateResult()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWithSuffix(t *testing.T) {
+	tests := []struct {
+		path, ext, suffix, want string
+	}{
+		{"/out/result.csv", ".csv", "_1", "/out/result_1.csv"},
+		{"/out/result.csv.csv", ".csv", "_2", "/out/result.csv_2.csv"},
+		{"/out/result", ".csv", "_1", "/out/result_1"},
+		{"/out/result.json", ".csv", "_1", "/out/result.json_1"},
+		{"/out/result", "", "_3", "/out/result_3"},
+	}
+	for _, tt := range tests {
+		if got := withSuffix(tt.path, tt.ext, tt.suffix); got != tt.want {
+			t.Errorf("withSuffix(%q, %q, %q) = %q, want %q", tt.path, tt.ext, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+// 模拟 Nexus 的 exists 接口，existing 中的路径视为已存在
+func fakeNexus(t *testing.T, existing ...string) *Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Params ReadParams `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		exists := false
+		for _, p := range existing {
+			exists = exists || p == req.Params.Path
+		}
+		json.NewEncoder(w).Encode(map[string]any{"jsonrpc": "2.0", "result": map[string]bool{"exists": exists}})
+	}))
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL, "")
+}
+
+func TestResultPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   *ResultConfig
+		format   string
+		existing []string
+		i, n     int
+		want     string
+	}{
+		{"default template", nil, "", nil, 0, 1, "/data/alice/tsql_result_20240102030405.csv"},
+		{"default template with several queries", nil, FormatJSON, nil, 1, 3, "/data/alice/tsql_result_20240102030405_2.json"},
+		{"placeholders", &ResultConfig{PathTemplate: "/out/{user}/{project}-{task_id}-{index}{ext}"}, FormatParquet, nil, 0, 2, "/out/alice/p1-t1-1.parquet"},
+		{"skip existing", &ResultConfig{PathTemplate: "/out/r{ext}"}, "", []string{"/out/r.csv", "/out/r_1.csv"}, 0, 1, "/out/r_2.csv"},
+		{"overwrite existing", &ResultConfig{PathTemplate: "/out/r{ext}", Overwrite: true}, "", []string{"/out/r.csv"}, 0, 1, "/out/r.csv"},
+	}
+	for _, tt := range tests {
+		r := &taskRunner{
+			taskID:    "t1",
+			projectID: "p1",
+			req:       &RunPrivacyRequest{User: "alice", Data: "/data/alice/input.csv", ResultFormat: tt.format, Result: tt.result},
+			client:    fakeNexus(t, tt.existing...),
+		}
+		got, err := r.resultPath(context.Background(), tt.i, tt.n, "20240102030405")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: resultPath = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	"github.com/apache/arrow/go/v17/arrow/array"
+	"github.com/apache/arrow/go/v17/arrow/memory"
+	"github.com/apache/arrow/go/v17/parquet/pqarrow"
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+)
+
+// 查询结果格式（同数据集格式，不含 tsv）对应的扩展名和 Content-Type
+var resultFormats = map[string]struct {
+	Ext         string
+	ContentType string
+}{
+	FormatCSV:     {".csv", "text/csv; charset=utf-8"},
+	FormatJSON:    {".json", "application/json"},
+	FormatJSONL:   {".jsonl", "application/x-ndjson"},
+	FormatParquet: {".parquet", "application/vnd.apache.parquet"},
+}
+
+// 请求的结果格式，默认 csv
+func (req *RunPrivacyRequest) resultFormat() string {
+	if req.ResultFormat == "" {
+		return FormatCSV
+	}
+	return strings.ToLower(req.ResultFormat)
+}
+
+func validateResultFormat(format string) error {
+	if _, ok := resultFormats[strings.ToLower(format)]; format != "" && !ok {
+		return fmt.Errorf("not support result format %v", format)
+	}
+	return nil
+}
+
+// 结果的行数，取第一列的长度；任一列的数据或 DataValidity 少于该行数时返回错误
+func tensorRows(tensors []*pb.Tensor) (int64, error) {
+	if len(tensors) == 0 {
+		return 0, nil
+	}
+	shape := tensors[0].GetShape()
+	if shape == nil || len(shape.Dim) == 0 {
+		return 0, fmt.Errorf("tensor %s has no shape", tensors[0].Name)
+	}
+	x, ok := shape.Dim[0].Value.(*pb.TensorShape_Dimension_DimValue)
+	if !ok {
+		return 0, fmt.Errorf("unexpected dimension type %T", shape.Dim[0].Value)
+	}
+	rows := x.DimValue
+	if rows < 0 {
+		return 0, fmt.Errorf("tensor %s has negative rows %d", tensors[0].Name, rows)
+	}
+	for _, t := range tensors {
+		n, err := tensorDataLen(t)
+		if err != nil {
+			return 0, err
+		}
+		if int64(n) < rows {
+			return 0, fmt.Errorf("column %s: %d values, want %d", t.Name, n, rows)
+		}
+		if len(t.DataValidity) > 0 && int64(len(t.DataValidity)) < rows {
+			return 0, fmt.Errorf("column %s: %d validity flags, want %d", t.Name, len(t.DataValidity), rows)
+		}
+	}
+	return rows, nil
+}
+
+// 列中按类型存放的值的个数
+func tensorDataLen(t *pb.Tensor) (int, error) {
+	switch t.ElemType {
+	case pb.PrimitiveDataType_STRING, pb.PrimitiveDataType_DATETIME:
+		return len(t.StringData), nil
+	case pb.PrimitiveDataType_INT8, pb.PrimitiveDataType_INT16, pb.PrimitiveDataType_INT32:
+		return len(t.Int32Data), nil
+	case pb.PrimitiveDataType_INT64, pb.PrimitiveDataType_TIMESTAMP:
+		return len(t.Int64Data), nil
+	case pb.PrimitiveDataType_FLOAT32:
+		return len(t.FloatData), nil
+	case pb.PrimitiveDataType_FLOAT64:
+		return len(t.DoubleData), nil
+	case pb.PrimitiveDataType_BOOL:
+		return len(t.BoolData), nil
+	}
+	return 0, fmt.Errorf("column %s: unsupported type %s", t.Name, t.ElemType)
+}
+
+// 结果列名，重名（如 JOIN 两侧的同名列）时加 _2、_3 后缀
+func resultColumnNames(tensors []*pb.Tensor) []string {
+	names := make([]string, len(tensors))
+	used := make(map[string]bool)
+	for i, t := range tensors {
+		name := t.Name
+		for n := 2; used[name]; n++ {
+			name = t.Name + "_" + strconv.Itoa(n)
+		}
+		used[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// 第 i 行的值，NULL 返回 nil；整数为 int64，浮点数为 float64，TIMESTAMP（unix 秒）为 time.Time
+func tensorValue(t *pb.Tensor, i int) (any, error) {
+	if len(t.DataValidity) > 0 && !t.DataValidity[i] {
+		return nil, nil
+	}
+	switch t.ElemType {
+	case pb.PrimitiveDataType_STRING, pb.PrimitiveDataType_DATETIME:
+		return t.StringData[i], nil
+	case pb.PrimitiveDataType_INT8, pb.PrimitiveDataType_INT16, pb.PrimitiveDataType_INT32:
+		return int64(t.Int32Data[i]), nil
+	case pb.PrimitiveDataType_INT64:
+		return t.Int64Data[i], nil
+	case pb.PrimitiveDataType_TIMESTAMP:
+		return time.Unix(t.Int64Data[i], 0).UTC(), nil
+	case pb.PrimitiveDataType_FLOAT32:
+		return float64(t.FloatData[i]), nil
+	case pb.PrimitiveDataType_FLOAT64:
+		return t.DoubleData[i], nil
+	case pb.PrimitiveDataType_BOOL:
+		return t.BoolData[i], nil
+	}
+	return nil, fmt.Errorf("column %s: unsupported type %s", t.Name, t.ElemType)
+}
+
+// 按 format 把查询结果写入 filename，返回行数
+func writeResult(filename, format string, tensors []*pb.Tensor) (int64, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rows, err := encodeResult(f, format, tensors)
+	if err != nil {
+		return 0, err
+	}
+	return rows, f.Close()
+}
+
+// 按 format 把查询结果写入 out，返回行数
+func encodeResult(out io.Writer, format string, tensors []*pb.Tensor) (int64, error) {
+	rows, err := tensorRows(tensors)
+	if err != nil {
+		return 0, err
+	}
+	switch format {
+	case FormatJSON, FormatJSONL:
+		err = writeJSONResult(out, format == FormatJSONL, tensors, rows)
+	case FormatParquet:
+		err = writeParquetResult(out, tensors, rows)
+	default:
+		err = writeCSVResult(out, tensors, rows)
+	}
+	return rows, err
+}
+
+// ================================
+// CSV（RFC 4180）：CRLF 换行，NULL 为空字段，空字符串为 ""
+// ================================
+func writeCSVResult(out io.Writer, tensors []*pb.Tensor, rows int64) error {
+	w := bufio.NewWriter(out)
+	for i, name := range resultColumnNames(tensors) {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(csvField(name, false))
+	}
+	w.WriteString("\r\n")
+
+	for r := 0; r < int(rows); r++ {
+		for i, t := range tensors {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			v, err := tensorValue(t, r)
+			if err != nil {
+				return err
+			}
+			switch v := v.(type) {
+			case nil:
+			case string:
+				w.WriteString(csvField(v, true))
+			default:
+				w.WriteString(formatResultValue(v))
+			}
+		}
+		w.WriteString("\r\n")
+	}
+	return w.Flush()
+}
+
+// 含逗号、引号、换行或首尾空白的字段加引号；quoteEmpty 时空字符串也加引号，与 NULL 区分
+func csvField(s string, quoteEmpty bool) string {
+	if s == "" {
+		if quoteEmpty {
+			return `""`
+		}
+		return ""
+	}
+	if strings.ContainsAny(s, ",\"\r\n") || strings.TrimSpace(s) != s {
+		return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	}
+	return s
+}
+
+// 非字符串值的文本形式
+func formatResultValue(v any) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(mysqlDatetimeLayout)
+	}
+	return fmt.Sprint(v)
+}
+
+// ================================
+// JSON：对象数组；JSONL：每行一个对象。NULL 和 NaN / Inf 为 null
+// ================================
+func writeJSONResult(out io.Writer, lines bool, tensors []*pb.Tensor, rows int64) error {
+	w := bufio.NewWriter(out)
+	names := resultColumnNames(tensors)
+	keys := make([][]byte, len(names))
+	for i, name := range names {
+		keys[i], _ = json.Marshal(name)
+	}
+
+	if !lines {
+		w.WriteByte('[')
+	}
+	for r := 0; r < int(rows); r++ {
+		if !lines && r > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteByte('{')
+		for i, t := range tensors {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.Write(keys[i])
+			w.WriteByte(':')
+			v, err := tensorValue(t, r)
+			if err != nil {
+				return err
+			}
+			switch x := v.(type) {
+			case float64:
+				if math.IsNaN(x) || math.IsInf(x, 0) {
+					v = nil
+				}
+			case time.Time:
+				v = x.Format(mysqlDatetimeLayout)
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			w.Write(b)
+		}
+		w.WriteByte('}')
+		if lines {
+			w.WriteByte('\n')
+		}
+	}
+	if !lines {
+		w.WriteString("]\n")
+	}
+	return w.Flush()
+}
+
+// ================================
+// Parquet：列类型取自 tensor，DATETIME 为字符串，TIMESTAMP 为 UTC 秒级时间戳
+// ================================
+func arrowType(t *pb.Tensor) (arrow.DataType, error) {
+	switch t.ElemType {
+	case pb.PrimitiveDataType_STRING, pb.PrimitiveDataType_DATETIME:
+		return arrow.BinaryTypes.String, nil
+	case pb.PrimitiveDataType_INT8, pb.PrimitiveDataType_INT16, pb.PrimitiveDataType_INT32:
+		return arrow.PrimitiveTypes.Int32, nil
+	case pb.PrimitiveDataType_INT64:
+		return arrow.PrimitiveTypes.Int64, nil
+	case pb.PrimitiveDataType_TIMESTAMP:
+		return &arrow.TimestampType{Unit: arrow.Second, TimeZone: "UTC"}, nil
+	case pb.PrimitiveDataType_FLOAT32:
+		return arrow.PrimitiveTypes.Float32, nil
+	case pb.PrimitiveDataType_FLOAT64:
+		return arrow.PrimitiveTypes.Float64, nil
+	case pb.PrimitiveDataType_BOOL:
+		return arrow.FixedWidthTypes.Boolean, nil
+	}
+	return nil, fmt.Errorf("column %s: unsupported type %s", t.Name, t.ElemType)
+}
+
+func writeParquetResult(out io.Writer, tensors []*pb.Tensor, rows int64) error {
+	names := resultColumnNames(tensors)
+	fields := make([]arrow.Field, len(tensors))
+	for i, t := range tensors {
+		dt, err := arrowType(t)
+		if err != nil {
+			return err
+		}
+		fields[i] = arrow.Field{Name: names[i], Type: dt, Nullable: true}
+	}
+	schema := arrow.NewSchema(fields, nil)
+
+	b := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer b.Release()
+	for i, t := range tensors {
+		n := int(rows)
+		valid := t.DataValidity
+		if len(valid) == 0 {
+			valid = nil
+		} else {
+			valid = valid[:n]
+		}
+		switch fb := b.Field(i).(type) {
+		case *array.StringBuilder:
+			fb.AppendValues(t.StringData[:n], valid)
+		case *array.Int32Builder:
+			fb.AppendValues(t.Int32Data[:n], valid)
+		case *array.Int64Builder:
+			fb.AppendValues(t.Int64Data[:n], valid)
+		case *array.TimestampBuilder:
+			for r := 0; r < n; r++ {
+				if valid != nil && !valid[r] {
+					fb.AppendNull()
+				} else {
+					fb.Append(arrow.Timestamp(t.Int64Data[r]))
+				}
+			}
+		case *array.Float32Builder:
+			fb.AppendValues(t.FloatData[:n], valid)
+		case *array.Float64Builder:
+			fb.AppendValues(t.DoubleData[:n], valid)
+		case *array.BooleanBuilder:
+			fb.AppendValues(t.BoolData[:n], valid)
+		}
+	}
+	rec := b.NewRecord()
+	defer rec.Release()
+
+	// pqarrow 关闭时会关闭 io.Closer，文件由调用方关闭
+	bw := bufio.NewWriter(out)
+	w, err := pqarrow.NewFileWriter(schema, bw, nil, pqarrow.DefaultWriterProps())
+	if err != nil {
+		return err
+	}
+	if err := w.Write(rec); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/v17/arrow"
+	pb "github.com/secretflow/scql/pkg/proto-gen/scql"
+)
+
+func TestCSVField(t *testing.T) {
+	tests := []struct {
+		value      string
+		quoteEmpty bool
+		want       string
+	}{
+		{"", false, ""},
+		{"", true, `""`},
+		{"abc", true, "abc"},
+		{"a,b", false, `"a,b"`},
+		{`say "hi"`, false, `"say ""hi"""`},
+		{"l1\nl2", false, "\"l1\nl2\""},
+		{"l1\rl2", false, "\"l1\rl2\""},
+		{" padded", false, `" padded"`},
+		{"tail\t", false, "\"tail\t\""},
+		{"中文", false, "中文"},
+	}
+	for _, tt := range tests {
+		if got := csvField(tt.value, tt.quoteEmpty); got != tt.want {
+			t.Errorf("csvField(%q, %v) = %q, want %q", tt.value, tt.quoteEmpty, got, tt.want)
+		}
+	}
+}
+
+func shape(rows int64) *pb.TensorShape {
+	return &pb.TensorShape{Dim: []*pb.TensorShape_Dimension{{Value: &pb.TensorShape_Dimension_DimValue{DimValue: rows}}}}
+}
+
+func TestWriteCSVResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		tensors []*pb.Tensor
+		rows    int64
+		want    string
+	}{
+		{
+			name: "null and empty string",
+			tensors: []*pb.Tensor{
+				{Name: "id", ElemType: pb.PrimitiveDataType_INT64, Shape: shape(3), Int64Data: []int64{1, 2, 3}, DataValidity: []bool{true, false, true}},
+				{Name: "name", ElemType: pb.PrimitiveDataType_STRING, Shape: shape(3), StringData: []string{"a,b", "", ""}, DataValidity: []bool{true, true, false}},
+			},
+			rows: 3,
+			want: "id,name\r\n1,\"a,b\"\r\n,\"\"\r\n3,\r\n",
+		},
+		{
+			name: "duplicate column names",
+			tensors: []*pb.Tensor{
+				{Name: "id", ElemType: pb.PrimitiveDataType_INT32, Shape: shape(1), Int32Data: []int32{7}},
+				{Name: "id", ElemType: pb.PrimitiveDataType_FLOAT64, Shape: shape(1), DoubleData: []float64{0.5}},
+				{Name: "ok", ElemType: pb.PrimitiveDataType_BOOL, Shape: shape(1), BoolData: []bool{true}},
+			},
+			rows: 1,
+			want: "id,id_2,ok\r\n7,0.5,true\r\n",
+		},
+		{
+			name: "timestamp",
+			tensors: []*pb.Tensor{
+				{Name: "ts", ElemType: pb.PrimitiveDataType_TIMESTAMP, Shape: shape(1), Int64Data: []int64{1700000000}},
+			},
+			rows: 1,
+			want: "ts\r\n2023-11-14 22:13:20\r\n",
+		},
+		{
+			name: "no rows",
+			tensors: []*pb.Tensor{
+				{Name: "a b", ElemType: pb.PrimitiveDataType_STRING, Shape: shape(0)},
+			},
+			rows: 0,
+			want: "a b\r\n",
+		},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		rows, err := tensorRows(tt.tensors)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if rows != tt.rows {
+			t.Errorf("%s: rows = %d, want %d", tt.name, rows, tt.rows)
+		}
+		if err := writeCSVResult(&buf, tt.tensors, rows); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 各格式共用的结果：NULL、空字符串、重名列、TIMESTAMP、NaN
+func sampleTensors() []*pb.Tensor {
+	return []*pb.Tensor{
+		{Name: "id", ElemType: pb.PrimitiveDataType_INT64, Shape: shape(3), Int64Data: []int64{1, 2, 3}, DataValidity: []bool{true, false, true}},
+		{Name: "id", ElemType: pb.PrimitiveDataType_STRING, Shape: shape(3), StringData: []string{"a\"b", "", ""}, DataValidity: []bool{true, true, false}},
+		{Name: "ts", ElemType: pb.PrimitiveDataType_TIMESTAMP, Shape: shape(3), Int64Data: []int64{1700000000, 0, 0}},
+		{Name: "score", ElemType: pb.PrimitiveDataType_FLOAT64, Shape: shape(3), DoubleData: []float64{0.5, math.NaN(), 2}},
+		{Name: "ok", ElemType: pb.PrimitiveDataType_BOOL, Shape: shape(3), BoolData: []bool{true, false, true}},
+	}
+}
+
+func TestEncodeJSONResult(t *testing.T) {
+	rows := []string{
+		`{"id":1,"id_2":"a\"b","ts":"2023-11-14 22:13:20","score":0.5,"ok":true}`,
+		`{"id":null,"id_2":"","ts":"1970-01-01 00:00:00","score":null,"ok":false}`,
+		`{"id":3,"id_2":null,"ts":"1970-01-01 00:00:00","score":2,"ok":true}`,
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{FormatJSON, "[" + strings.Join(rows, ",") + "]\n"},
+		{FormatJSONL, strings.Join(rows, "\n") + "\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		n, err := encodeResult(&buf, tt.format, sampleTensors())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		if n != 3 {
+			t.Errorf("%s: rows = %d, want 3", tt.format, n)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.format, got, tt.want)
+		}
+	}
+
+	// 没有行时 JSON 为空数组，JSONL 为空
+	empty := []*pb.Tensor{{Name: "a", ElemType: pb.PrimitiveDataType_STRING, Shape: shape(0)}}
+	for format, want := range map[string]string{FormatJSON: "[]\n", FormatJSONL: ""} {
+		var buf bytes.Buffer
+		if _, err := encodeResult(&buf, format, empty); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("%s empty: got %q, want %q", format, got, want)
+		}
+	}
+}
+
+func TestEncodeParquetResult(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "result.parquet")
+	n, err := writeResult(path, FormatParquet, sampleTensors())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("rows = %d, want 3", n)
+	}
+
+	r, err := newParquetReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, want := strings.Join(r.Header(), ","), "id,id_2,ts,score,ok"; got != want {
+		t.Errorf("header = %s, want %s", got, want)
+	}
+	types := []arrow.Type{arrow.INT64, arrow.STRING, arrow.TIMESTAMP, arrow.FLOAT64, arrow.BOOL}
+	for i, field := range r.rr.Schema().Fields() {
+		if field.Type.ID() != types[i] {
+			t.Errorf("column %s type = %s, want %s", field.Name, field.Type, types[i])
+		}
+	}
+
+	var got []string
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := make([]string, len(record))
+		for i, v := range record {
+			fields[i] = str(v)
+		}
+		got = append(got, strings.Join(fields, "|"))
+	}
+	want := []string{
+		`"1"|"a"b"|"2023-11-14 22:13:20Z"|"0.5"|"true"`,
+		`<nil>|""|"1970-01-01 00:00:00Z"|"NaN"|"false"`,
+		`"3"|<nil>|"1970-01-01 00:00:00Z"|"2"|"true"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rows:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestTensorRowsBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		tensors []*pb.Tensor
+		wantErr string
+	}{
+		{
+			name: "short data",
+			tensors: []*pb.Tensor{
+				{Name: "id", ElemType: pb.PrimitiveDataType_INT64, Shape: shape(2), Int64Data: []int64{1, 2}},
+				{Name: "name", ElemType: pb.PrimitiveDataType_STRING, Shape: shape(2), StringData: []string{"a"}},
+			},
+			wantErr: "column name: 1 values, want 2",
+		},
+		{
+			name: "short validity",
+			tensors: []*pb.Tensor{
+				{Name: "id", ElemType: pb.PrimitiveDataType_INT32, Shape: shape(2), Int32Data: []int32{1, 2}, DataValidity: []bool{true}},
+			},
+			wantErr: "column id: 1 validity flags, want 2",
+		},
+		{
+			name: "data in wrong field",
+			tensors: []*pb.Tensor{
+				{Name: "ts", ElemType: pb.PrimitiveDataType_TIMESTAMP, Shape: shape(1), StringData: []string{"2024-01-01"}},
+			},
+			wantErr: "column ts: 0 values, want 1",
+		},
+	}
+	for _, tt := range tests {
+		for _, format := range []string{FormatCSV, FormatJSON, FormatParquet} {
+			_, err := encodeResult(io.Discard, format, tt.tensors)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s %s: err = %v, want %q", tt.name, format, err, tt.wantErr)
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 可配置重试的操作，对应请求中 retry 的 key
+const (
+	RetryInvite        = "invite"         // 发起方邀请协作方
+	RetryJoin          = "join"           // 等待协作方加入 / 等待邀请
+	RetryCreateTable   = "create_table"   // 在项目中创建表
+	RetryRunQuery      = "run_query"      // 执行查询或提交查询作业
+	RetryRestartBroker = "restart_broker" // supervisorctl restart broker
+	RetryReady         = "ready"          // 等待 MySQL、broker 和 engine 就绪
+)
+
+// 重试的退避参数，间隔和时间为秒（可为小数），未设置或为 0 的字段使用操作的默认值
+type RetryConfig struct {
+	// 第一次重试前的等待
+	InitialInterval float64 `json:"initial_interval,omitempty"`
+	// 等待的上限
+	MaxInterval float64 `json:"max_interval,omitempty"`
+	// 每次重试后等待时间的倍数，不小于 1
+	Multiplier float64 `json:"multiplier,omitempty"`
+	// 随机抖动比例（0~1），实际等待在 d*(1-jitter) 到 d*(1+jitter) 之间
+	Jitter float64 `json:"jitter,omitempty"`
+	// 最多尝试次数（含第一次），默认值为 0 时不限制
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// 从第一次尝试起的最长时间，默认值为 0 时只受阶段超时限制
+	MaxElapsed float64 `json:"max_elapsed,omitempty"`
+}
+
+// 重试失败后的处理
+type retryAction int
+
+const (
+	retryAgain retryAction = iota // 等待后重试
+	retryStop                     // 不再重试，返回错误
+	retryDone                     // 视为成功
+)
+
+// 按错误类型（ErrAlreadyExists 等）决定的处理，未列出的类型和无法归类的错误按 Other
+type retryPolicy struct {
+	On    map[error]retryAction
+	Other retryAction
+}
+
+func (p retryPolicy) action(err error) retryAction {
+	for kind, action := range p.On {
+		if errors.Is(err, kind) {
+			return action
+		}
+	}
+	return p.Other
+}
+
+// 各操作的默认退避参数和按错误类型的处理：参数错误、无权限和项目状态冲突时重试也不会成功
+var retryOps = map[string]struct {
+	conf   RetryConfig
+	policy retryPolicy
+}{
+	RetryInvite: {
+		RetryConfig{InitialInterval: 1, MaxInterval: 30, Multiplier: 2, Jitter: 0.2},
+		retryPolicy{On: map[error]retryAction{
+			ErrAlreadyExists:    retryDone, // 对方已是项目成员
+			ErrNotFound:         retryStop,
+			ErrPermissionDenied: retryStop,
+			ErrInvalidArgument:  retryStop,
+			ErrConflict:         retryStop,
+		}},
+	},
+	RetryJoin: {
+		RetryConfig{InitialInterval: 1, MaxInterval: 10, Multiplier: 1.5, Jitter: 0.2},
+		retryPolicy{On: map[error]retryAction{
+			ErrPermissionDenied: retryStop,
+			ErrInvalidArgument:  retryStop,
+			ErrConflict:         retryStop,
+		}},
+	},
+	RetryCreateTable: {
+		RetryConfig{InitialInterval: 1, MaxInterval: 10, Multiplier: 2, Jitter: 0.2},
+		retryPolicy{On: map[error]retryAction{
+			ErrAlreadyExists:    retryDone, // 已检查过不是其他任务留下的表
+			ErrNotFound:         retryStop,
+			ErrPermissionDenied: retryStop,
+			ErrInvalidArgument:  retryStop,
+			ErrConflict:         retryStop,
+		}},
+	},
+	// SQL 错误、CCL 检查失败等不重试
+	RetryRunQuery: {
+		RetryConfig{InitialInterval: 1, MaxInterval: 30, Multiplier: 2, Jitter: 0.2, MaxAttempts: queryAttempts},
+		retryPolicy{On: map[error]retryAction{
+			ErrNotFound:         retryStop,
+			ErrPermissionDenied: retryStop,
+			ErrInvalidArgument:  retryStop,
+			ErrConflict:         retryStop,
+		}},
+	},
+	RetryRestartBroker: {
+		RetryConfig{InitialInterval: 1, MaxInterval: 10, Multiplier: 2, Jitter: 0.2, MaxAttempts: 10},
+		retryPolicy{},
+	},
+	RetryReady: {
+		RetryConfig{InitialInterval: 1, MaxInterval: 5, Multiplier: 1.5, Jitter: 0.2, MaxElapsed: 120},
+		retryPolicy{},
+	},
+}
+
+func validateRetry(retry map[string]RetryConfig, allowed ...string) error {
+	for op, c := range retry {
+		if _, ok := retryOps[op]; !ok || (len(allowed) > 0 && !slices.Contains(allowed, op)) {
+			return fmt.Errorf("retry: not support operation %s", op)
+		}
+		if c.InitialInterval < 0 || c.MaxInterval < 0 || c.MaxAttempts < 0 || c.MaxElapsed < 0 {
+			return fmt.Errorf("retry.%s: intervals, max_attempts and max_elapsed must not be negative", op)
+		}
+		if c.Multiplier != 0 && c.Multiplier < 1 {
+			return fmt.Errorf("retry.%s: multiplier must not be less than 1", op)
+		}
+		if c.Jitter < 0 || c.Jitter > 1 {
+			return fmt.Errorf("retry.%s: jitter must be between 0 and 1", op)
+		}
+	}
+	return nil
+}
+
+// 操作 op 的退避参数：请求中的 retry 覆盖默认值
+func (req *RunPrivacyRequest) retryConfig(op string) RetryConfig {
+	c := retryOps[op].conf
+	o := req.Retry[op]
+	if o.InitialInterval > 0 {
+		c.InitialInterval = o.InitialInterval
+	}
+	if o.MaxInterval > 0 {
+		c.MaxInterval = o.MaxInterval
+	}
+	if o.Multiplier > 0 {
+		c.Multiplier = o.Multiplier
+	}
+	if o.Jitter > 0 {
+		c.Jitter = o.Jitter
+	}
+	if o.MaxAttempts > 0 {
+		c.MaxAttempts = o.MaxAttempts
+	}
+	if o.MaxElapsed > 0 {
+		c.MaxElapsed = o.MaxElapsed
+	}
+	if c.MaxInterval < c.InitialInterval {
+		c.MaxInterval = c.InitialInterval
+	}
+	return c
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// 第 attempt 次失败后的等待时间
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	d := math.Min(c.InitialInterval*math.Pow(c.Multiplier, float64(attempt-1)), c.MaxInterval)
+	if c.Jitter > 0 {
+		d *= 1 + c.Jitter*(2*rand.Float64()-1)
+	}
+	return seconds(d)
+}
+
+// 任务状态中的重试记录
+type RetryStatus struct {
+	Operation   string     `json:"operation"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+	// 最终是否成功，重试中为 false
+	Succeeded bool      `json:"succeeded"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// 按操作 op 的退避参数和错误处理执行 fn，直到成功、策略要求停止、次数或时间用尽或 ctx 结束；
+// name 为事件和任务状态中的操作名，如 inviteMember bob
+func (t *taskRunner) withRetry(ctx context.Context, op, name string, fn func(attempt int) error) error {
+	conf := t.req.retryConfig(op)
+	policy := retryOps[op].policy
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || policy.action(err) == retryDone {
+			if err != nil {
+				log.Warnf("[task=%s] %s: %s", t.taskID, name, err.Error())
+			}
+			if attempt > 1 {
+				t.setRetry(name, op, attempt, nil, nil)
+			}
+			return nil
+		}
+		if policy.action(err) == retryStop {
+			t.setRetry(name, op, attempt, err, nil)
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if conf.MaxAttempts > 0 && attempt >= conf.MaxAttempts {
+			t.setRetry(name, op, attempt, err, nil)
+			return fmt.Errorf("%s: too many attempts: %w", name, err)
+		}
+		delay := conf.backoff(attempt)
+		if conf.MaxElapsed > 0 && time.Since(started)+delay > seconds(conf.MaxElapsed) {
+			t.setRetry(name, op, attempt, err, nil)
+			return fmt.Errorf("%s: gave up after %d attempts in %s: %w", name, attempt, time.Since(started).Round(time.Millisecond), err)
+		}
+		next := time.Now().Add(delay)
+		t.setRetry(name, op, attempt, err, &next)
+		t.retry(name, attempt, err, delay)
+		if serr := sleepCtx(ctx, delay); serr != nil {
+			return waitErr(ctx, err)
+		}
+	}
+}
+
+func (t *taskRunner) setRetry(name, op string, attempt int, err error, next *time.Time) {
+	status := &RetryStatus{
+		Operation:   op,
+		Attempts:    attempt,
+		NextRetryAt: next,
+		Succeeded:   err == nil,
+		UpdatedAt:   time.Now(),
+	}
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	updateTask(t.taskID, func(rec *TaskRecord) {
+		if rec.Retries == nil {
+			rec.Retries = make(map[string]*RetryStatus)
+		}
+		rec.Retries[name] = status
+	})
+}
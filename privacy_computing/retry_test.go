@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryConfigBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    RetryConfig
+		attempt int
+		want    time.Duration
+	}{
+		{"first", RetryConfig{InitialInterval: 1, MaxInterval: 30, Multiplier: 2}, 1, time.Second},
+		{"doubles", RetryConfig{InitialInterval: 1, MaxInterval: 30, Multiplier: 2}, 4, 8 * time.Second},
+		{"capped", RetryConfig{InitialInterval: 1, MaxInterval: 30, Multiplier: 2}, 10, 30 * time.Second},
+		{"fractional", RetryConfig{InitialInterval: 0.5, MaxInterval: 10, Multiplier: 1.5}, 3, 1125 * time.Millisecond},
+		{"constant", RetryConfig{InitialInterval: 2, MaxInterval: 2, Multiplier: 1}, 5, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := tt.conf.backoff(tt.attempt); got != tt.want {
+			t.Errorf("%s: backoff(%d) = %s, want %s", tt.name, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryConfigBackoffJitter(t *testing.T) {
+	conf := RetryConfig{InitialInterval: 1, MaxInterval: 30, Multiplier: 2, Jitter: 0.2}
+	for attempt, base := range map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 8: 30 * time.Second} {
+		lo, hi := base*8/10, base*12/10
+		for range 100 {
+			if got := conf.backoff(attempt); got < lo || got > hi {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", attempt, got, lo, hi)
+			}
+		}
+	}
+}
+
+func TestRetryConfigOverride(t *testing.T) {
+	tests := []struct {
+		name  string
+		retry map[string]RetryConfig
+		want  RetryConfig
+	}{
+		{"defaults", nil, retryOps[RetryInvite].conf},
+		{
+			"override",
+			map[string]RetryConfig{RetryInvite: {MaxInterval: 60, MaxAttempts: 3}},
+			RetryConfig{InitialInterval: 1, MaxInterval: 60, Multiplier: 2, Jitter: 0.2, MaxAttempts: 3},
+		},
+		{
+			"max raised to initial",
+			map[string]RetryConfig{RetryInvite: {InitialInterval: 45}},
+			RetryConfig{InitialInterval: 45, MaxInterval: 45, Multiplier: 2, Jitter: 0.2},
+		},
+		{
+			"other operation",
+			map[string]RetryConfig{RetryJoin: {MaxInterval: 60}},
+			retryOps[RetryInvite].conf,
+		},
+	}
+	for _, tt := range tests {
+		req := &RunPrivacyRequest{Retry: tt.retry}
+		if got := req.retryConfig(RetryInvite); got != tt.want {
+			t.Errorf("%s: retryConfig = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		retry   map[string]RetryConfig
+		allowed []string
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"valid", map[string]RetryConfig{RetryRunQuery: {InitialInterval: 0.5, Multiplier: 1, Jitter: 1}}, nil, false},
+		{"unknown operation", map[string]RetryConfig{"download": {}}, nil, true},
+		{"not allowed", map[string]RetryConfig{RetryInvite: {}}, []string{RetryRunQuery}, true},
+		{"negative", map[string]RetryConfig{RetryInvite: {MaxAttempts: -1}}, nil, true},
+		{"multiplier below 1", map[string]RetryConfig{RetryInvite: {Multiplier: 0.5}}, nil, true},
+		{"jitter above 1", map[string]RetryConfig{RetryInvite: {Jitter: 1.5}}, nil, true},
+	}
+	for _, tt := range tests {
+		if err := validateRetry(tt.retry, tt.allowed...); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateRetry err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -2,21 +2,23 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
-var resultFile = "/home/user/result.csv"
-var DATAFILE = "/home/user/data.csv"
+// 每个任务的工作目录 <taskWorkDir>/<task_id>，存放数据和结果文件
+var taskWorkDir = "/home/user/tasks"
 var dsn = "root:@tcp(127.0.0.1:3306)/engine?charset=utf8mb4&parseTime=True"
 
 type RunPrivacyRequest struct {
@@ -35,13 +37,104 @@ type RunPrivacyRequest struct {
 	UserURL   string `json:"userurl"`
 	EngineURL string `json:"engineURL"`
 
-	Party struct {
-		User     string `json:"user"`
-		PubKey   string `json:"pubkey"`
-		PartyURL string `json:"partyURL"`
-	} `json:"party"`
+	// 单个协作方，兼容旧请求；多方计算使用 Parties
+	Party Party `json:"party"`
+	// 协作方列表（不含本节点），非空时忽略 Party
+	Parties []Party `json:"parties,omitempty"`
+
+	// 未声明类型的列按数据推断类型，否则为 string
+	InferTypes bool `json:"infer_types,omitempty"`
+	// 导入时允许拒绝的行数，超过时任务失败
+	MaxRejectedRows int `json:"max_rejected_rows,omitempty"`
+	// 数据集格式，不设置时按文件扩展名和内容识别
+	DataFormat *DataFormat `json:"data_format,omitempty"`
+	// 查询方式：async（默认，提交作业后轮询结果）/ sync
+	QueryMode string `json:"query_mode,omitempty"`
+	// 结果格式：csv（默认）/ json / jsonl / parquet
+	ResultFormat string `json:"result_format,omitempty"`
+	// 结果的上传路径、是否覆盖和接收方
+	Result *ResultConfig `json:"result,omitempty"`
+	// 检查重复值的关联键，默认为有 PLAINTEXT_AFTER_JOIN 权限的列
+	JoinKeys []string `json:"join_keys,omitempty"`
+	// 本方的表授予协作方的 CCL 策略，与 columns[].permissions 合并
+	CCLPolicy *CCLPolicy `json:"ccl_policy,omitempty"`
 
 	RunSQL string `json:"runsql"`
+	// runsql 之后依次执行的查询，每条查询单独生成结果文件
+	Queries []string `json:"queries,omitempty"`
+
+	// SPU 协议，兼容旧请求；新请求使用 ProjectConf.Protocol
+	SpuProtocol string `json:"spu_protocol,omitempty"`
+	// 项目配置，发起方创建项目和执行查询时使用
+	ProjectConf *ProjectConfig `json:"project_conf,omitempty"`
+
+	// 项目 ID，发起方可选，默认按任务生成；协作方指定时只接受该项目的邀请
+	ProjectID string `json:"project_id,omitempty"`
+	// 协作方等待的邀请方，默认为任一协作方
+	Inviter string `json:"inviter,omitempty"`
+	// 协作方对不匹配的邀请的处理：ignore（默认）/ reject
+	UnmatchedInvitations string `json:"unmatched_invitations,omitempty"`
+
+	// 任务总超时（秒），0 表示不限制
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// 各阶段超时（秒），key 为阶段名，如 NEGOTIATING
+	PhaseTimeouts map[TaskPhase]int `json:"phase_timeouts"`
+	// 各操作的重试退避参数，key 为 invite / join / create_table / run_query / restart_broker / ready
+	Retry map[string]RetryConfig `json:"retry,omitempty"`
+
+	// 任务结束时的回调
+	Callback *TaskCallback `json:"callback,omitempty"`
+	// 任务成功后自动清理，同 POST /tasks/{id}/cleanup；清理后不能再在其项目上执行查询
+	AutoCleanup bool `json:"auto_cleanup,omitempty"`
+}
+
+// 协作方
+type Party struct {
+	User     string `json:"user"`
+	PubKey   string `json:"pubkey"`
+	PartyURL string `json:"partyURL"`
+}
+
+// 本任务的所有协作方
+func (req *RunPrivacyRequest) partners() []Party {
+	if len(req.Parties) > 0 {
+		return req.Parties
+	}
+	if req.Party.User != "" {
+		return []Party{req.Party}
+	}
+	return nil
+}
+
+// 校验协作方、列类型和列权限中的参与方
+func validateParties(req *RunPrivacyRequest) error {
+	partners := req.partners()
+	if len(partners) == 0 {
+		return errors.New("missing party")
+	}
+	members := map[string]bool{req.User: true}
+	for _, p := range partners {
+		members[p.User] = true
+	}
+	for _, column := range req.Columns {
+		if err := validateIdent(column.Column); err != nil {
+			return fmt.Errorf("column: %w", err)
+		}
+		if _, ok := normalizeDtype(column.Type); column.Type != "" && !ok {
+			return fmt.Errorf("column %s: unknown type %s", column.Column, column.Type)
+		}
+		for _, per := range column.Permissions {
+			if !members[per.User] {
+				return fmt.Errorf("column %s: unknown party %s", column.Column, per.User)
+			}
+		}
+	}
+	for _, key := range req.JoinKeys {
+		if err := validateIdent(key); err != nil {
+			return fmt.Errorf("join_keys: %w", err)
+		}
+	}
+	return nil
 }
 
 type RunPrivacyResponse struct {
@@ -66,12 +159,104 @@ func runPrivacyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing required fields", http.StatusBadRequest)
 		return
 	}
+	if req.MaxRejectedRows < 0 {
+		http.Error(w, "max_rejected_rows must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := req.DataFormat.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateResultFormat(req.ResultFormat); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateQueryMode(req.QueryMode); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateQueries(req.Queries); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 只有 queries 时第一条作为 runsql，发起方以 runsql 判断
+	if req.RunSQL == "" && len(req.Queries) > 0 {
+		req.RunSQL, req.Queries = req.Queries[0], req.Queries[1:]
+	}
+	if req.TimeoutSeconds < 0 {
+		http.Error(w, "timeout_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+	for phase, sec := range req.PhaseTimeouts {
+		if phaseIndex(phase) < 0 || sec < 0 {
+			http.Error(w, fmt.Sprintf("invalid phase timeout %s=%d", phase, sec), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := validateRetry(req.Retry); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.Callback.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateParties(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateInvitation(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := req.cclGrants(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validateResult(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.projectConfig().Validate(len(req.partners()) + 1); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateBrokerConfig(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// ===== 生成任务 ID =====
 	taskID := uuid.NewString()
 
+	// ===== 记录任务 =====
+	now := time.Now()
+	rec := &TaskRecord{
+		ID:        taskID,
+		User:      req.User,
+		Data:      req.Data,
+		Phase:     PhasePending,
+		ProjectID: req.ProjectID,
+		Table:     taskTableName(req.User, taskID),
+		Queries:   req.queryRecords(),
+		Request:   &req,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	// 协作方的项目 ID 在接受邀请后确定
+	if rec.ProjectID == "" && req.RunSQL != "" {
+		rec.ProjectID = "tsql_" + shortTaskID(taskID)
+	}
+	req.Callback.stashSecret(taskID)
+	err := taskStore.Create(rec)
+	if err != nil {
+		forgetCallbackSecret(taskID)
+		http.Error(w, "create task failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// ===== 异步启动隐私计算任务 =====
-	go startPrivacyTask(taskID, &req)
+	go startPrivacyTask(rec)
 
 	resp := RunPrivacyResponse{
 		TaskID: taskID,
@@ -82,260 +267,672 @@ func runPrivacyHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-// 读取 task.json 替换网络变量
-func DealTask(req *RunPrivacyRequest) {
-	replaceInFile("/home/user/config/config.yml", map[string]string{
-		"_NODE_NAME_":       req.User,
-		"_NODE_ENGINE_URL_": req.EngineURL,
-	})
-	replaceInFile("/home/user/config/party_info.json", map[string]string{
-		"_NODE_NAME_":        req.User,
-		"_PARTY_NAME_":       req.Party.User,
-		"_PARTY_PUBKEY_":     req.Party.PubKey,
-		"_PARTY_SERVER_URL_": req.Party.PartyURL,
-		"_NODE_SERVER_URL_":  req.UserURL,
-		"_NODE_PUBKEY_":      req.UserKey,
-	})
+// 查询任务状态
+func getTaskHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := taskStore.Get(r.PathValue("id"))
+	if err == ErrTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 不返回旧版本写入记录的回调密钥
+	if rec.Request != nil && rec.Request.Callback != nil && rec.Request.Callback.Secret != "" {
+		rec.Request.Callback.Secret = redactedSecret
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
 }
 
-func checkDataset(req *RunPrivacyRequest) error {
-	db, err := GetDB(dsn)
+// 查询任务的数据集导入结果和概况
+func getTaskDatasetHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := taskStore.Get(r.PathValue("id"))
+	if err == ErrTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		return err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rec.Dataset == nil {
+		http.Error(w, "dataset not loaded", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec.Dataset)
+}
+
+// 恢复执行的起始阶段：失败的阶段，排队时就已失败的任务从头开始
+func (rec *TaskRecord) resumePhase() TaskPhase {
+	if phaseIndex(rec.FailedPhase) >= 0 {
+		return rec.FailedPhase
 	}
+	if rec.BaseTaskID != "" {
+		return PhaseQuerying
+	}
+	return PhaseConfiguring
+}
 
-	f, err := os.Open(DATAFILE)
+// 从失败的阶段恢复执行任务
+func resumeTaskHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := taskStore.Get(r.PathValue("id"))
+	if err == ErrTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Fatalf("failed to open file: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rec.Phase != PhaseFailed || rec.Request == nil {
+		http.Error(w, fmt.Sprintf("task in phase %s can not be resumed", rec.Phase), http.StatusConflict)
+		return
+	}
+	if rec.CleanedAt != nil {
+		http.Error(w, "task has been cleaned up", http.StatusConflict)
+		return
 	}
-	defer f.Close()
 
-	// 创建 CSV reader
-	reader := csv.NewReader(f)
+	// 先重新排队，避免同一任务被重复恢复
+	if err := transitionTask(rec.ID, PhasePending, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	go runTaskFrom(newTaskRunner(rec), rec.resumePhase())
 
-	// 读取第一行（表头）
-	header, err := reader.Read()
-	if err != nil {
-		log.Fatalf("failed to read header: %v", err)
+	resp := RunPrivacyResponse{
+		TaskID: rec.ID,
+		Status: "resumed",
 	}
 
-	err = ExecSQL(db, fmt.Sprintf("drop table IF EXISTS %s", req.User))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// 取消任务：正在执行的任务通过 context 取消，其余未结束的任务直接标记为 CANCELLED
+func cancelTaskHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := taskStore.Get(r.PathValue("id"))
+	if err == ErrTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		return err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rec.Phase.IsTerminal() {
+		http.Error(w, fmt.Sprintf("task already %s", rec.Phase), http.StatusConflict)
+		return
 	}
-	create_table_sql := fmt.Sprintf("CREATE TABLE %s (", req.User)
-	for n, column := range header {
-		if n > 0 {
-			create_table_sql += ","
+
+	status := "cancelling"
+	if !cancelRunningTask(rec.ID) {
+		// 任务不在本进程执行（例如服务重启前提交的任务）
+		if err := transitionTask(rec.ID, PhaseCancelled, errTaskCancelled); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
 		}
-		create_table_sql += fmt.Sprintf("%s varchar(512)", column)
+		if rec.Request != nil {
+			go newTaskRunner(rec).cleanup(rec.Phase)
+		}
+		status = "cancelled"
 	}
-	create_table_sql += ") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;"
 
-	err = ExecSQL(db, create_table_sql)
-	if err != nil {
-		return err
+	resp := RunPrivacyResponse{
+		TaskID: rec.ID,
+		Status: status,
 	}
 
-	err = ExecSQL(db, fmt.Sprintf("delete from %s", req.User))
-	if err != nil {
-		return err
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func startPrivacyTask(rec *TaskRecord) {
+	req := rec.Request
+	log.Printf("[task=%s] start privacy compute", rec.ID)
+	log.Printf("[task=%s] input data: %s", rec.ID, req.Data)
+	log.Printf("[task=%s] run sql: %s", rec.ID, req.RunSQL)
+	log.Printf("[task=%s] engine url: %s", rec.ID, req.EngineURL)
+
+	runTaskFrom(newTaskRunner(rec), PhaseConfiguring)
+}
+
+// 单个任务的执行上下文
+type taskRunner struct {
+	taskID    string
+	req       *RunPrivacyRequest
+	client    *Client
+	projectID string // SCQL 项目
+	table     string // MySQL 表 engine.<table>
+	workDir   string
+	dataset   *DatasetReport
+	jobID     string // 正在执行的异步查询的作业 ID
+	// 在已有任务的项目上执行查询时为该任务 ID，项目和表不属于本任务
+	baseTaskID string
+	// 是否已共享使用 broker（brokerUsers）
+	brokerHeld bool
+	// 是否已独占 broker，等待重启
+	brokerExclusive bool
+}
+
+func newTaskRunner(rec *TaskRecord) *taskRunner {
+	return &taskRunner{
+		taskID:     rec.ID,
+		req:        rec.Request,
+		client:     NewClient(os.Getenv("NEXUS_SERVER_URL"), os.Getenv("NEXUS_API_KEY")),
+		projectID:  rec.ProjectID,
+		table:      rec.Table,
+		workDir:    filepath.Join(taskWorkDir, rec.ID),
+		dataset:    rec.Dataset,
+		jobID:      rec.JobID,
+		baseTaskID: rec.BaseTaskID,
 	}
+}
+
+// 保留 Nexus 路径的扩展名，用于识别数据集格式
+func (t *taskRunner) dataFile() string {
+	ext := strings.ToLower(filepath.Ext(t.req.Data))
+	if ext == "" {
+		ext = ".csv"
+	}
+	return filepath.Join(t.workDir, "data"+ext)
+}
 
-	load_data_sql := fmt.Sprintf(`
-		LOAD DATA INFILE '%s' INTO TABLE %s
-		FIELDS TERMINATED BY ','      
-		ENCLOSED BY '"'               
-		LINES TERMINATED BY '\n'      
-		IGNORE 1 LINES                
-		(%s)`, DATAFILE, req.User, strings.Join(header, ","))
+// 第 i 条查询的结果文件
+func (t *taskRunner) resultFile(i int) string {
+	return filepath.Join(t.workDir, fmt.Sprintf("result_%d%s", i+1, resultFormats[t.req.resultFormat()].Ext))
+}
 
-	return ExecSQL(db, load_data_sql)
+// 任务 ID 的前 8 位，用于生成项目 ID 和表名
+func shortTaskID(taskID string) string {
+	id := strings.ReplaceAll(taskID, "-", "")
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return id
 }
 
-func startPrivacyTask(taskID string, req *RunPrivacyRequest) {
-	log.Printf("[task=%s] start privacy compute", taskID)
-	log.Printf("[task=%s] input data: %s", taskID, req.Data)
-	log.Printf("[task=%s] run sql: %s", taskID, req.RunSQL)
-	log.Printf("[task=%s] engine url: %s", taskID, req.EngineURL)
+// 写配置和重启 broker 会影响所有任务，需要串行执行；重启前还需等待其他任务不再使用 broker（brokerUsers），
+// 等待时不持有该锁，其他任务可以继续渲染配置
+var brokerConfigMu sync.Mutex
 
-	DealTask(req)
+// 磁盘上的配置已变化但 broker 尚未重启（重启失败，或任务在等待重启时超时、取消），
+// 之后的任务即使配置没有变化也需要重启；由 brokerConfigMu 保护
+var brokerRestartPending bool
 
-	for {
-		err := RunCmd("supervisorctl restart broker")
-		if err != nil {
-			log.Debugf("[task=%s] err:%s", taskID, err.Error())
-			time.Sleep(time.Second)
-		} else {
-			break
-		}
+// CONFIGURING 之后的阶段共享使用 broker，直到任务结束
+func (t *taskRunner) holdBroker(ctx context.Context, phase TaskPhase) error {
+	if t.brokerHeld || phase == PhaseConfiguring {
+		return nil
+	}
+	if err := brokerUsers.acquire(ctx); err != nil {
+		return fmt.Errorf("wait for broker restart: %w", err)
 	}
+	t.brokerHeld = true
+	return nil
+}
 
-	i := 60
-	for i > 0 {
-		if IsPortOpen("3306") {
-			log.Debugf("[task=%s] 3306 is ok", taskID)
-			break
-		}
-		time.Sleep(time.Second)
-		i--
+func (t *taskRunner) releaseBroker() {
+	if t.brokerHeld {
+		brokerUsers.release()
+		t.brokerHeld = false
 	}
+	if t.brokerExclusive {
+		brokerUsers.unlockExclusive()
+		t.brokerExclusive = false
+	}
+}
 
-	// download data.csv
-	client := NewClient(os.Getenv("NEXUS_SERVER_URL"), os.Getenv("NEXUS_API_KEY"))
-	data, err := client.ReadFile(context.Background(), req.Data)
+// 第一个阶段或 CONFIGURING 开始计时前：渲染网络配置，配置变化时等待其他任务不再使用 broker 后独占 broker。
+// 等待时间不计入阶段超时，只受任务总超时和取消限制
+func (t *taskRunner) prepareConfigure(ctx context.Context) error {
+	brokerConfigMu.Lock()
+	changed, err := renderBrokerConfig(brokerConfigFromRequest(t.taskID, t.req))
+	if changed {
+		brokerRestartPending = true
+	}
+	restart := brokerRestartPending
+	brokerConfigMu.Unlock()
 	if err != nil {
-		log.Errorf("[task=%s] err:%s", taskID, err.Error())
-		return
+		return err
+	}
+	// 配置没有变化且已生效时不重启 broker，避免中断其他任务
+	if !restart {
+		log.Infof("[task=%s] broker config unchanged", t.taskID)
+		return nil
 	}
-	err = os.WriteFile(DATAFILE, data, os.ModePerm)
+	if !changed {
+		log.Infof("[task=%s] broker config not applied yet, restart broker", t.taskID)
+	}
+
+	// 等待其他任务结束后再重启，避免中断它们的 broker 调用和查询
+	err = brokerUsers.lockExclusive(ctx, func(users int) {
+		emitEvent(t.taskID, EventRetry, map[string]int{"running_tasks": users}, "waiting for %d running task(s) before restarting broker", users)
+	})
 	if err != nil {
-		log.Errorf("[task=%s] err:%s", taskID, err.Error())
-		return
+		return fmt.Errorf("wait for running tasks before restarting broker: %w", err)
 	}
-	err = checkDataset(req)
+	t.brokerExclusive = true
+	return nil
+}
+
+// CONFIGURING：配置变化时重启 broker
+func (t *taskRunner) configure(ctx context.Context) error {
+	if err := t.applyBrokerConfig(ctx); err != nil {
+		return err
+	}
+	return t.waitReady(ctx, CheckMySQL)
+}
+
+// 已独占 broker 时重启 broker 并释放独占，等待 broker 就绪
+func (t *taskRunner) applyBrokerConfig(ctx context.Context) error {
+	if !t.brokerExclusive {
+		return nil
+	}
+	err := t.restartBroker(ctx)
+	t.releaseBroker()
 	if err != nil {
-		log.Errorf("[task=%s] err:%s", taskID, err.Error())
-		return
+		return err
 	}
+	return t.waitReady(ctx, CheckBroker)
+}
 
-	i = 60
-	for i > 0 {
-		if IsPortOpen("8080") && IsPortOpen("8081") && IsPortOpen("8003") {
-			log.Debugf("[task=%s] 8080/8003 is ok", taskID)
-			break
-		}
-		time.Sleep(time.Second)
-		i--
+// 重启 broker 使磁盘上的配置生效；重启期间不渲染配置，等待期间其他任务已重启时跳过
+func (t *taskRunner) restartBroker(ctx context.Context) error {
+	brokerConfigMu.Lock()
+	defer brokerConfigMu.Unlock()
+	if !brokerRestartPending {
+		log.Infof("[task=%s] broker already restarted by another task", t.taskID)
+		return nil
+	}
+	err := t.withRetry(ctx, RetryRestartBroker, "restart broker", func(int) error {
+		return RunCmd(ctx, "supervisorctl restart broker")
+	})
+	if err != nil {
+		return err
+	}
+	brokerRestartPending = false
+	return nil
+}
+
+// LOADING_DATA：从 Nexus 分块下载数据并流式导入 MySQL
+func (t *taskRunner) loadData(ctx context.Context) error {
+	if err := os.MkdirAll(t.workDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(t.dataFile(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	size, err := t.client.ReadFileTo(ctx, t.req.Data, f, func(written int64) {
+		t.progress("download", written, 0)
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	report, err := checkDataset(ctx, t.dataFile(), t.table, t.req, func(stage string, rows int64) {
+		t.progress(stage, size, rows)
+	})
+	if err == nil {
+		report.Profile, err = profileDataset(ctx, t.table, report, t.req)
+	}
+	if report != nil {
+		t.dataset = report
+		updateTask(t.taskID, func(rec *TaskRecord) {
+			rec.Dataset = report
+		})
+	}
+	return err
+}
+
+// NEGOTIATING：发起方创建项目并邀请协作方，协作方接受邀请
+func (t *taskRunner) negotiate(ctx context.Context) error {
+	if err := t.waitReady(ctx, CheckBroker, CheckBrokerInter, CheckEngine); err != nil {
+		return err
 	}
 
+	req := t.req
 	if req.RunSQL != "" {
-		log.Debugf("[task=%s] RunSQL--->ok", taskID)
-		err := createProject()
+		log.Debugf("[task=%s] RunSQL--->ok", t.taskID)
+		conf, err := req.projectConfig().projectConf()
 		if err != nil {
-			if !strings.Contains(err.Error(), "project tsql already exists") {
-				log.Errorf("[task=%s] createProject err %s", taskID, err.Error())
-				return
-			}
+			return err
 		}
-		// invite member
-		for {
-			err := inviteMember(req.Party.User)
+		err = createProject(ctx, t.projectID, conf)
+		if err != nil {
+			if !errors.Is(err, ErrAlreadyExists) {
+				return fmt.Errorf("createProject: %w", err)
+			}
+			// 只沿用本方创建且未归档的项目（如恢复执行时）
+			project, err := getProject(ctx, t.projectID)
 			if err != nil {
-				if strings.Contains(err.Error(), "project already contains invitee") {
-					break
-				}
-				log.Debugf("[task=%s] inviteMember waiting... %s", taskID, err.Error())
-				time.Sleep(3 * time.Second)
-			} else {
-				break
+				return fmt.Errorf("createProject: %w", err)
+			}
+			if project != nil && project.Creator != req.User {
+				return fmt.Errorf("project %s already exists and was created by %s", t.projectID, project.Creator)
 			}
+			if project != nil && project.Archived {
+				return fmt.Errorf("project %s already exists and is archived", t.projectID)
+			}
+			log.Infof("[task=%s] project %s already exists, reuse it", t.taskID, t.projectID)
 		}
-		// wait for joined
-		for {
-			joined, err := ProjectMemberJoined(req.Party.User)
+		// invite members
+		for _, party := range req.partners() {
+			err := t.withRetry(ctx, RetryInvite, "inviteMember "+party.User, func(int) error {
+				return inviteMember(ctx, t.projectID, party.User)
+			})
 			if err != nil {
-				log.Debugf("[task=%s] err:%s ", taskID, err.Error())
-				time.Sleep(time.Second)
-				continue
-			}
-			if !joined {
-				log.Debugf("[task=%s] wait for %s join", taskID, req.Party.User)
-				time.Sleep(time.Second)
-			} else {
-				break
+				return err
 			}
 		}
-		log.Infof("[task=%s] ProjectMemberJoined ok", taskID)
-	} else {
-		// wait for create project
-		for {
-			joined, err := JoinProject()
+		// wait for all members joined
+		joined := make(map[string]bool)
+		return t.withRetry(ctx, RetryJoin, "wait for join", func(int) error {
+			members, err := ProjectMembers(ctx, t.projectID)
 			if err != nil {
-				if strings.Contains(err.Error(), "record not found") {
-					log.Debugf("[task=%s] err:%s ", taskID, err.Error())
-					break
+				return err
+			}
+			var waiting []string
+			for _, party := range req.partners() {
+				if joined[party.User] {
+					continue
+				}
+				if !slices.Contains(members, party.User) {
+					waiting = append(waiting, party.User)
+					continue
 				}
-				log.Debugf("[task=%s] err:%s ", taskID, err.Error())
-				time.Sleep(time.Second)
-				continue
+				joined[party.User] = true
+				emitEvent(t.taskID, EventJoined, map[string]string{"party": party.User, "project": t.projectID}, "%s joined project %s", party.User, t.projectID)
 			}
-			if !joined {
-				log.Debugf("[task=%s] wait for create project", taskID)
-				time.Sleep(time.Second)
-			} else {
-				break
+			if len(waiting) > 0 {
+				return fmt.Errorf("%s has not joined", strings.Join(waiting, ","))
+			}
+			return nil
+		})
+	}
+
+	// wait for the invitation of this task
+	return t.withRetry(ctx, RetryJoin, "wait for invitation", func(int) error {
+		inv, err := t.acceptInvitation(ctx)
+		if err != nil {
+			return err
+		}
+		if inv == nil {
+			return errors.New("no matching invitation received")
+		}
+		t.setInvitation(inv)
+		emitEvent(t.taskID, EventJoined, map[string]any{"project": t.projectID, "inviter": inv.GetInviter(), "invitation_id": inv.GetInvitationId()},
+			"joined project %s invited by %s", t.projectID, inv.GetInviter())
+		return nil
+	})
+}
+
+// GRANTING：创建表并授予列级权限
+func (t *taskRunner) grant(ctx context.Context) error {
+	req := t.req
+	// 项目中已有本方的表但指向其他任务的 MySQL 表时（如之前的任务留下的），先删除
+	tables, err := listTables(ctx, t.projectID, req.User)
+	if err != nil {
+		return fmt.Errorf("list tables: %w", err)
+	}
+	for _, table := range tables {
+		if table.Name == req.User && table.RefTable != "engine."+t.table {
+			log.Warnf("[task=%s] drop stale table %s -> %s", t.taskID, table.Name, table.RefTable)
+			if _, err := dropProjectTable(ctx, t.projectID, req.User); err != nil {
+				return fmt.Errorf("drop stale table: %w", err)
 			}
 		}
-		log.Infof("[task=%s] JoinProject ok", taskID)
 	}
 	// create vtable
-	for {
-		err := createTable(req)
+	err = t.withRetry(ctx, RetryCreateTable, "createTable", func(int) error {
+		return createTable(ctx, t.projectID, t.table, req, t.dataset)
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("[task=%s] createTable ok", t.taskID)
+
+	// 策略已在提交时校验
+	grants, err := req.cclGrants()
+	if err != nil {
+		return err
+	}
+	for _, g := range grants {
+		name := t.dataset.columnName(g.Column)
+		if name == "" {
+			name = g.Column
+		}
+		if err := t.grantCCL(ctx, g.Party, name, g.Constraint); err != nil {
+			return fmt.Errorf("grant %s on %s to %s: %w", g.Constraint, name, g.Party, err)
+		}
+	}
+	log.Infof("[task=%s] grantCCL ok", t.taskID)
+	log.Infof("[task=%s] wait for party grant!!", t.taskID)
+	return nil
+}
+
+// QUERYING：依次执行各条查询，结果写入任务目录；恢复执行时跳过已成功的查询。
+// 单条查询失败不影响其余查询，全部执行后有失败的查询时阶段失败；接收结果的协作方等待结果文件
+func (t *taskRunner) query(ctx context.Context) error {
+	if t.req.RunSQL == "" {
+		return t.receiveResults(ctx)
+	}
+	// 在已有项目上执行查询的任务直接从 QUERYING 开始
+	if err := t.waitReady(ctx, CheckBroker, CheckEngine); err != nil {
+		return err
+	}
+	jobConf, err := t.req.projectConfig().jobConf()
+	if err != nil {
+		return err
+	}
+	queries, err := t.queries()
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	var lastErr error
+	for i, q := range queries {
+		resultFile := t.resultFile(i)
+		// 本方不接收结果时没有结果文件
+		if q.ResultPath != "" || (q.Status == QuerySucceeded && (FileExists(resultFile) || !t.req.receivesResult())) {
+			continue
+		}
+		log.Infof("[task=%s]  runQuery %d/%d...", t.taskID, i+1, len(queries))
+		os.Remove(resultFile)
+		started := time.Now()
+		t.updateQuery(i, func(q *QueryRecord) {
+			q.Status = QueryRunning
+			q.Error = ""
+			q.StartedAt = &started
+			q.FinishedAt = nil
+		})
+
+		var rows int64
+		sql, err := t.routedSQL(i, q.SQL)
+		switch {
+		case err != nil:
+		case t.req.queryMode() == QueryModeSync:
+			rows, err = t.querySync(ctx, i, sql, resultFile, jobConf)
+		default:
+			rows, err = t.queryAsync(ctx, i, q.JobID, sql, resultFile, jobConf)
+		}
+
+		finished := time.Now()
+		status := QuerySucceeded
 		if err != nil {
-			if strings.Contains(err.Error(), "already exists") {
-				log.Errorf("[task=%s] err:%s ", taskID, err.Error())
-				break
+			status = QueryFailed
+		}
+		t.updateQuery(i, func(q *QueryRecord) {
+			q.Status = status
+			q.RowCount = rows
+			q.FinishedAt = &finished
+			if err != nil {
+				q.Error = err.Error()
 			}
-			log.Debugf("[task=%s] err:%s ", taskID, err.Error())
-			time.Sleep(time.Second)
-			continue
-		} else {
-			break
+		})
+		data := map[string]any{"index": i, "status": status, "row_count": rows}
+		if err != nil {
+			data["error"] = err.Error()
 		}
+		emitEvent(t.taskID, EventQuery, data, "query %d/%d %s", i+1, len(queries), status)
+		if err != nil {
+			// 超时或取消时不再执行后续查询
+			if ctx.Err() != nil {
+				return err
+			}
+			failed++
+			lastErr = err
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	if len(queries) == 1 {
+		return lastErr
 	}
-	log.Infof("[task=%s] createTable ok", taskID)
+	return fmt.Errorf("%d of %d queries failed: %w", failed, len(queries), lastErr)
+}
 
-	for _, column := range req.Columns {
-		err := grantCCL(req.User, req.User, column.Column, "PLAINTEXT")
+// 同步执行查询，失败时重试
+func (t *taskRunner) querySync(ctx context.Context, i int, sql, resultFile, jobConf string) (int64, error) {
+	var rows int64
+	err := t.withRetry(ctx, RetryRunQuery, fmt.Sprintf("runQuery %d", i+1), func(attempt int) error {
+		t.updateQuery(i, func(q *QueryRecord) {
+			q.Attempts = attempt
+		})
+		result, err := runQuery(ctx, t.projectID, sql, jobConf)
+		if err == nil {
+			rows, err = t.saveResult(i, resultFile, result)
+		}
+		if err == nil && !FileExists(resultFile) && t.req.receivesResult() {
+			err = errors.New("query returned no result")
+		}
 		if err != nil {
-			log.Error(err.Error())
+			updateTask(t.taskID, func(rec *TaskRecord) {
+				rec.LastError = err.Error()
+			})
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	log.Info(resultFile, " result success")
+	return rows, nil
+}
+
+// UPLOADING：按路径模板上传各条查询的结果文件到 Nexus，已上传的跳过；本方不接收结果时没有需要上传的文件
+func (t *taskRunner) upload(ctx context.Context) error {
+	if !t.req.receivesResult() {
+		return nil
+	}
+	queries, err := t.queries()
+	if err != nil {
+		return err
+	}
+	format := t.req.resultFormat()
+	contentType := resultFormats[format].ContentType
+	stamp := time.Now().Format("20060102150405")
+	for i, q := range queries {
+		if q.Status != QuerySucceeded || q.ResultPath != "" {
 			continue
 		}
-		for _, per := range column.Permissions {
-			err = grantCCL(per.User, req.User, column.Column, per.Permission)
-			if err != nil {
-				log.Error(err.Error())
-			}
+		data, err := os.ReadFile(t.resultFile(i))
+		if err != nil {
+			return err
+		}
+		resultPath, err := t.resultPath(ctx, i, len(queries), stamp)
+		if err != nil {
+			return err
 		}
+		result, err := t.client.WriteFile(ctx, resultPath, data)
+		if err != nil {
+			return err
+		}
+		log.Infof("[task=%s] nexusfs WriteFile etag:%s size %d", t.taskID, result.Etag, result.Size)
+		emitEvent(t.taskID, EventResult, map[string]any{"index": i, "path": resultPath, "etag": result.Etag, "size": result.Size, "format": format, "content_type": contentType},
+			"privacy compute finished upload file to nexusfs: filepath: %s", resultPath)
+		t.updateQuery(i, func(q *QueryRecord) {
+			q.ResultPath = resultPath
+			q.ResultFormat = format
+			q.ResultContentType = contentType
+		})
+	}
+	return nil
+}
+
+// 授予 CCL 并发布授权事件
+func (t *taskRunner) grantCCL(ctx context.Context, party, column, constraint string) error {
+	err := grantCCL(ctx, t.projectID, party, t.req.User, column, constraint)
+	if err != nil {
+		log.Errorf("[task=%s] grant %s on %s to %s err:%s", t.taskID, constraint, column, party, err.Error())
+		return err
 	}
-	log.Infof("[task=%s] grantCCL ok", taskID)
-	log.Infof("[task=%s] wait for party grant!!", taskID)
+	emitEvent(t.taskID, EventGrant, map[string]string{"party": party, "table": t.req.User, "column": column, "constraint": constraint},
+		"grant %s on %s.%s to %s", constraint, t.req.User, column, party)
+	return nil
+}
 
-	if req.RunSQL == "" {
-		log.Infof("[task=%s] RunSQL empty", taskID)
+// 记录数据下载和导入进度并发布进度事件
+func (t *taskRunner) progress(stage string, bytes, rows int64) {
+	p := &TaskProgress{Stage: stage, Bytes: bytes, Rows: rows, UpdatedAt: time.Now()}
+	updateTask(t.taskID, func(rec *TaskRecord) {
+		rec.Progress = p
+	})
+	emitEvent(t.taskID, EventProgress, p, "%s: %d bytes, %d rows", stage, bytes, rows)
+}
+
+// 发布重试事件
+func (t *taskRunner) retry(op string, attempt int, err error, delay time.Duration) {
+	emitEvent(t.taskID, EventRetry, map[string]any{"operation": op, "attempt": attempt, "error": err.Error(), "delay_ms": delay.Milliseconds()},
+		"%s attempt %d: %s, retry in %s", op, attempt, err.Error(), delay.Round(time.Millisecond))
+}
+
+// 清理任务执行到 reached 阶段时留下的项目、表和本地数据
+func (t *taskRunner) cleanup(reached TaskPhase) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if reached == PhaseQuerying && t.jobID != "" {
+		if err := cancelQuery(ctx, t.jobID); err != nil {
+			log.Errorf("[task=%s] cancel job %s err:%s", t.taskID, t.jobID, err.Error())
+		}
+	}
+	// 项目和表属于 baseTaskID 对应的任务
+	if t.baseTaskID != "" {
+		os.RemoveAll(t.workDir)
+		log.Infof("[task=%s] cleanup finished", t.taskID)
 		return
 	}
-	log.Infof("[task=%s]  runQuery...", taskID)
-	i = 0
-	for {
-		i++
-		if i > 30 {
-			log.Errorf("[task=%s]  too many attempts", taskID)
-			break
+	if phaseIndex(reached) >= phaseIndex(PhaseNegotiating) && t.projectID != "" {
+		if err := cleanupProject(ctx, t.projectID, t.req); err != nil {
+			log.Errorf("[task=%s] cleanup project err:%s", t.taskID, err.Error())
 		}
-		err := runQuery(req.RunSQL, resultFile)
-		if err != nil {
-			log.Errorf("[task=%s] err:%s", taskID, err.Error())
-			time.Sleep(time.Second)
-			continue
+	}
+	if phaseIndex(reached) >= phaseIndex(PhaseLoadingData) {
+		db, err := GetDB(dsn)
+		var table string
+		if err == nil {
+			table, err = quoteIdent(t.table)
 		}
-		if FileExists(resultFile) {
-			log.Info(resultFile, " result success")
-			data, err := os.ReadFile(resultFile)
-			if err != nil {
-				log.Errorf("[task=%s] err:%s", taskID, err.Error())
-				break
-			}
-			resultFile := fmt.Sprintf("%s/tsql_result_%s.csv", filepath.Dir(req.Data), time.Now().Format("20060102150405"))
-			result, err := client.WriteFile(context.Background(), resultFile, data)
-			if err != nil {
-				log.Errorf("[task=%s] err:%s", taskID, err.Error())
-				break
-			}
-			log.Infof("[task=%s] nexusfs WriteFile etag:%s size %d", taskID, result.Etag, result.Size)
-			log.Printf("[task=%s] privacy compute finished upload file to nexusfs: filepath: %s", taskID, resultFile)
-			break
+		if err == nil {
+			err = ExecSQLContext(ctx, db, fmt.Sprintf("drop table IF EXISTS %s", table))
+		}
+		if err != nil {
+			log.Errorf("[task=%s] cleanup table err:%s", t.taskID, err.Error())
 		}
 	}
+	os.RemoveAll(t.workDir)
+	log.Infof("[task=%s] cleanup finished", t.taskID)
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 回调请求头
+const (
+	callbackSignatureHeader = "X-Signature-256"
+	callbackTaskHeader      = "X-Task-Id"
+	callbackTimestampHeader = "X-Timestamp"
+)
+
+// 回调投递次数
+const callbackAttempts = 3
+
+// 任务记录中代替回调密钥的占位符
+const redactedSecret = "******"
+
+// 回调密钥只保存在本进程内存中，不写入任务记录；进程重启后需要签名的回调不再投递
+var (
+	callbackSecretsMu sync.Mutex
+	callbackSecrets   = map[string]string{}
+)
+
+// 任务结束回调，Secret 非空时使用 HMAC-SHA256 对时间戳和请求体签名
+type TaskCallback struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+func (c *TaskCallback) Validate() error {
+	if c == nil {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid callback url: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid callback url: must be an absolute http(s) url")
+	}
+	if c.Secret == redactedSecret {
+		return errors.New("invalid callback secret")
+	}
+	return nil
+}
+
+// 写入任务记录前调用：密钥保存到内存，请求中的密钥替换为占位符
+func (c *TaskCallback) stashSecret(taskID string) {
+	if c == nil || c.Secret == "" {
+		return
+	}
+	callbackSecretsMu.Lock()
+	callbackSecrets[taskID] = c.Secret
+	callbackSecretsMu.Unlock()
+	c.Secret = redactedSecret
+}
+
+// 回调签名使用的密钥，旧版本写入记录的明文密钥直接使用
+func (c *TaskCallback) secret(taskID string) (string, error) {
+	if c.Secret != redactedSecret {
+		return c.Secret, nil
+	}
+	callbackSecretsMu.Lock()
+	defer callbackSecretsMu.Unlock()
+	secret, ok := callbackSecrets[taskID]
+	if !ok {
+		return "", errors.New("callback secret is not available after restart")
+	}
+	return secret, nil
+}
+
+func forgetCallbackSecret(taskID string) {
+	callbackSecretsMu.Lock()
+	delete(callbackSecrets, taskID)
+	callbackSecretsMu.Unlock()
+}
+
+// 回调请求体
+type TaskCallbackPayload struct {
+	TaskID     string    `json:"task_id"`
+	Status     TaskPhase `json:"status"`
+	ResultPath string    `json:"result_path,omitempty"`
+	RowCount   int64     `json:"row_count"`
+	// 各条查询的状态和结果
+	Queries    []QueryRecord `json:"queries,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	ErrorCode  string        `json:"error_code,omitempty"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+var callbackClient = &http.Client{Timeout: 10 * time.Second}
+
+// 任务结束时回调，失败时重试，投递结果写入任务记录
+func notifyCallback(rec *TaskRecord) {
+	if rec.Request == nil || rec.Request.Callback == nil {
+		return
+	}
+	cb := rec.Request.Callback
+	// FAILED 的任务可以恢复执行，密钥保留到任务最终结束
+	if rec.Phase != PhaseFailed {
+		defer forgetCallbackSecret(rec.ID)
+	}
+
+	payload := TaskCallbackPayload{
+		TaskID:     rec.ID,
+		Status:     rec.Phase,
+		ResultPath: rec.ResultPath,
+		RowCount:   rec.RowCount,
+		Queries:    rec.Queries,
+		ErrorCode:  rec.ErrorCode,
+		FinishedAt: rec.FinishedAt,
+	}
+	if rec.Phase != PhaseSucceeded {
+		payload.Error = rec.LastError
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Errorf("[task=%s] marshal callback err:%s", rec.ID, err.Error())
+		return
+	}
+
+	secret, err := cb.secret(rec.ID)
+	if err != nil {
+		log.Errorf("[task=%s] callback %s err:%s", rec.ID, cb.URL, err.Error())
+	} else {
+		for attempt := 1; attempt <= callbackAttempts; attempt++ {
+			err = postCallback(cb.URL, secret, rec.ID, body)
+			if err == nil {
+				break
+			}
+			log.Errorf("[task=%s] callback %s attempt %d err:%s", rec.ID, cb.URL, attempt, err.Error())
+			if attempt < callbackAttempts {
+				time.Sleep(time.Duration(attempt) * 2 * time.Second)
+			}
+		}
+	}
+
+	updateTask(rec.ID, func(rec *TaskRecord) {
+		if err != nil {
+			rec.CallbackStatus = "failed"
+			rec.CallbackError = err.Error()
+		} else {
+			rec.CallbackStatus = "delivered"
+			rec.CallbackError = ""
+		}
+	})
+	if err == nil {
+		log.Infof("[task=%s] callback %s delivered", rec.ID, cb.URL)
+	}
+}
+
+func postCallback(url, secret, taskID string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(callbackTaskHeader, taskID)
+	// 每次投递使用新的时间戳，接收方据此拒绝重放的旧请求
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(callbackTimestampHeader, timestamp)
+	if secret != "" {
+		req.Header.Set(callbackSignatureHeader, "sha256="+signCallback(secret, timestamp, body))
+	}
+
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback status: %s", resp.Status)
+	}
+	return nil
+}
+
+// 签名内容为 "<timestamp>.<body>"
+func signCallback(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
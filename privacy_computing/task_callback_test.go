@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignCallback(t *testing.T) {
+	// HMAC-SHA256("key", "1700000000.The quick brown fox jumps over the lazy dog")
+	got := signCallback("key", "1700000000", []byte("The quick brown fox jumps over the lazy dog"))
+	if want := "2f658d6aef4f246e91cd741bbcded7479e9605f9d41c9e248122a117e0e1765b"; got != want {
+		t.Errorf("signCallback = %s, want %s", got, want)
+	}
+}
+
+func TestPostCallback(t *testing.T) {
+	body := []byte(`{"task_id":"t1","status":"SUCCEEDED"}`)
+	tests := []struct {
+		name    string
+		secret  string
+		status  int
+		wantErr bool
+	}{
+		{"signed", "s3cret", http.StatusOK, false},
+		{"unsigned", "", http.StatusNoContent, false},
+		{"rejected", "s3cret", http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		var gotSig, gotTask, gotTimestamp string
+		var gotBody []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotSig = r.Header.Get(callbackSignatureHeader)
+			gotTask = r.Header.Get(callbackTaskHeader)
+			gotTimestamp = r.Header.Get(callbackTimestampHeader)
+			gotBody, _ = io.ReadAll(r.Body)
+			w.WriteHeader(tt.status)
+		}))
+		start := time.Now().Unix()
+		err := postCallback(srv.URL, tt.secret, "t1", body)
+		srv.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if ts, err := strconv.ParseInt(gotTimestamp, 10, 64); err != nil || ts < start || ts > time.Now().Unix() {
+			t.Errorf("%s: timestamp %q", tt.name, gotTimestamp)
+		}
+		wantSig := ""
+		if tt.secret != "" {
+			wantSig = "sha256=" + signCallback(tt.secret, gotTimestamp, body)
+		}
+		if gotSig != wantSig || gotTask != "t1" || string(gotBody) != string(body) {
+			t.Errorf("%s: signature %q task %q body %s", tt.name, gotSig, gotTask, gotBody)
+		}
+	}
+}
+
+func TestTaskCallbackValidate(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://agent/hooks/privacy", false},
+		{"http://10.0.0.1:8080/cb", false},
+		{"ftp://agent/cb", true},
+		{"/hooks/privacy", true},
+		{"http://", true},
+	}
+	for _, tt := range tests {
+		if err := (&TaskCallback{URL: tt.url}).Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%s) err = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCallbackSecret(t *testing.T) {
+	cb := &TaskCallback{URL: "https://agent/cb", Secret: "s3cret"}
+	cb.stashSecret("t1")
+	if cb.Secret != redactedSecret {
+		t.Fatalf("secret not redacted: %q", cb.Secret)
+	}
+	if err := cb.Validate(); err == nil {
+		t.Error("Validate accepted the redaction placeholder as secret")
+	}
+	if got, err := cb.secret("t1"); err != nil || got != "s3cret" {
+		t.Errorf("secret = %q, %v", got, err)
+	}
+	// 进程重启后内存中没有密钥
+	forgetCallbackSecret("t1")
+	if _, err := cb.secret("t1"); err == nil {
+		t.Error("secret after restart: want error")
+	}
+	// 旧版本写入记录的明文密钥
+	if got, err := (&TaskCallback{Secret: "old"}).secret("t2"); err != nil || got != "old" {
+		t.Errorf("plaintext secret = %q, %v", got, err)
+	}
+	// 未设置密钥时不签名
+	var unsigned TaskCallback
+	unsigned.stashSecret("t3")
+	if got, err := unsigned.secret("t3"); err != nil || got != "" {
+		t.Errorf("unsigned secret = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 任务事件类型
+const (
+	EventPhase      = "phase"      // 阶段切换
+	EventQueued     = "queued"     // 排队等待执行
+	EventRetry      = "retry"      // 等待或重试
+	EventProgress   = "progress"   // 数据下载和导入进度
+	EventJoined     = "joined"     // 协作方加入项目
+	EventInvitation = "invitation" // 拒绝不匹配的邀请
+	EventGrant      = "grant"      // CCL 授权
+	EventJob        = "job"        // 查询作业已提交
+	EventQuery      = "query"      // 单条查询执行结束
+	EventResult     = "result"     // 结果上传完成
+)
+
+// 每个任务最多保留的事件数
+const maxTaskEvents = 1000
+
+// 任务结束后事件保留时间，便于晚到的订阅者回放
+const taskEventsRetention = time.Hour
+
+type TaskEvent struct {
+	ID      int       `json:"id"`
+	TaskID  string    `json:"task_id"`
+	Type    string    `json:"type"`
+	Phase   TaskPhase `json:"phase,omitempty"`
+	Message string    `json:"message"`
+	Data    any       `json:"data,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// 内存中的任务事件，支持回放和订阅
+type taskEventHub struct {
+	mu     sync.Mutex
+	nextID map[string]int
+	events map[string][]TaskEvent
+	subs   map[string]map[chan TaskEvent]struct{}
+	// 任务结束后清理事件的定时器，任务恢复执行时取消
+	expire map[string]*time.Timer
+}
+
+var taskEvents = &taskEventHub{
+	nextID: make(map[string]int),
+	events: make(map[string][]TaskEvent),
+	subs:   make(map[string]map[chan TaskEvent]struct{}),
+	expire: make(map[string]*time.Timer),
+}
+
+func (h *taskEventHub) publish(ev TaskEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID[ev.TaskID]++
+	ev.ID = h.nextID[ev.TaskID]
+	ev.Time = time.Now()
+
+	events := append(h.events[ev.TaskID], ev)
+	if len(events) > maxTaskEvents {
+		events = events[len(events)-maxTaskEvents:]
+	}
+	h.events[ev.TaskID] = events
+
+	for ch := range h.subs[ev.TaskID] {
+		select {
+		case ch <- ev:
+		default:
+			// 订阅者处理过慢时不丢弃事件（包括结束事件），关闭订阅，由客户端通过 Last-Event-ID 重新连接并回放
+			delete(h.subs[ev.TaskID], ch)
+			close(ch)
+		}
+	}
+	if len(h.subs[ev.TaskID]) == 0 {
+		delete(h.subs, ev.TaskID)
+	}
+
+	if ev.Type == EventPhase {
+		h.scheduleExpire(ev.TaskID, ev.Phase.IsTerminal())
+	}
+}
+
+// 任务结束时重新计时，保留期后清理事件；任务恢复执行（离开结束阶段）时取消
+func (h *taskEventHub) scheduleExpire(taskID string, terminal bool) {
+	if timer := h.expire[taskID]; timer != nil {
+		timer.Stop()
+		delete(h.expire, taskID)
+	}
+	if !terminal {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(taskEventsRetention, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.expire[taskID] != timer {
+			return
+		}
+		delete(h.expire, taskID)
+		if len(h.subs[taskID]) == 0 {
+			delete(h.events, taskID)
+			delete(h.nextID, taskID)
+		}
+	})
+	h.expire[taskID] = timer
+}
+
+// 订阅任务事件，返回 afterID 之后的历史事件
+func (h *taskEventHub) subscribe(taskID string, afterID int) ([]TaskEvent, chan TaskEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var history []TaskEvent
+	for _, ev := range h.events[taskID] {
+		if ev.ID > afterID {
+			history = append(history, ev)
+		}
+	}
+
+	ch := make(chan TaskEvent, 64)
+	if h.subs[taskID] == nil {
+		h.subs[taskID] = make(map[chan TaskEvent]struct{})
+	}
+	h.subs[taskID][ch] = struct{}{}
+
+	// 订阅可能已因处理过慢被 publish 关闭
+	return history, ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[taskID], ch)
+		if len(h.subs[taskID]) == 0 {
+			delete(h.subs, taskID)
+		}
+	}
+}
+
+// 记录日志并发布任务事件
+func emitEvent(taskID, typ string, data any, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if typ == EventRetry {
+		log.Debugf("[task=%s] %s", taskID, msg)
+	} else {
+		log.Infof("[task=%s] %s", taskID, msg)
+	}
+	taskEvents.publish(TaskEvent{
+		TaskID:  taskID,
+		Type:    typ,
+		Message: msg,
+		Data:    data,
+	})
+}
+
+func emitPhase(taskID string, phase TaskPhase, cause error) {
+	msg := fmt.Sprintf("phase -> %s", phase)
+	if cause != nil {
+		msg += ": " + cause.Error()
+	}
+	log.Infof("[task=%s] %s", taskID, msg)
+	taskEvents.publish(TaskEvent{
+		TaskID:  taskID,
+		Type:    EventPhase,
+		Phase:   phase,
+		Message: msg,
+	})
+}
+
+// SSE 推送任务进度，任务结束后关闭连接
+func taskEventsHandler(w http.ResponseWriter, r *http.Request) {
+	rec, err := taskStore.Get(r.PathValue("id"))
+	if err == ErrTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	history, ch, unsubscribe := taskEvents.subscribe(rec.ID, lastID)
+	defer unsubscribe()
+	// 订阅后重新读取，避免订阅前任务阶段变化
+	if cur, err := taskStore.Get(rec.ID); err == nil {
+		rec = cur
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(ev TaskEvent) bool {
+		data, _ := json.Marshal(ev)
+		fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+		flusher.Flush()
+		return ev.Type == EventPhase && ev.Phase.IsTerminal()
+	}
+
+	// 回放全部历史事件：恢复执行的任务历史中有之前的 FAILED，只有最后一个阶段事件为当前的结束阶段时才关闭
+	final := -1
+	for i, ev := range history {
+		if ev.Type == EventPhase {
+			final = i
+		}
+	}
+	for _, ev := range history {
+		write(ev)
+	}
+	if final >= 0 && history[final].Phase.IsTerminal() && history[final].Phase == rec.Phase {
+		return
+	}
+	// 事件已过期（或服务重启过）的已结束任务，直接返回最终状态
+	if rec.Phase.IsTerminal() && final < 0 {
+		write(TaskEvent{
+			TaskID:  rec.ID,
+			Type:    EventPhase,
+			Phase:   rec.Phase,
+			Message: fmt.Sprintf("phase -> %s", rec.Phase),
+			Time:    rec.UpdatedAt,
+		})
+		return
+	}
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case ev, ok := <-ch:
+			if !ok || write(ev) {
+				return
+			}
+		}
+	}
+}
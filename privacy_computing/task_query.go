@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// 单条查询的状态
+const (
+	QueryPending   = "PENDING"
+	QueryRunning   = "RUNNING"
+	QuerySucceeded = "SUCCEEDED"
+	QueryFailed    = "FAILED"
+)
+
+// 单条查询的执行记录
+type QueryRecord struct {
+	SQL      string `json:"sql"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts,omitempty"`
+	// 结果共享时提交过的作业数，作业 ID 为 sharedJobID(项目, 序号, Submits)
+	Submits   int             `json:"submits,omitempty"`
+	JobID     string          `json:"job_id,omitempty"`
+	JobStatus *QueryJobStatus `json:"job_status,omitempty"`
+	RowCount  int64           `json:"row_count"`
+	// 上传到 Nexus 的结果文件
+	ResultPath        string     `json:"result_path,omitempty"`
+	ResultFormat      string     `json:"result_format,omitempty"`
+	ResultContentType string     `json:"result_content_type,omitempty"`
+	Error             string     `json:"error,omitempty"`
+	StartedAt         *time.Time `json:"started_at,omitempty"`
+	FinishedAt        *time.Time `json:"finished_at,omitempty"`
+}
+
+// 任务要执行的全部查询：runsql 在前，其后为 queries
+func (req *RunPrivacyRequest) queries() []string {
+	var queries []string
+	if req.RunSQL != "" {
+		queries = append(queries, req.RunSQL)
+	}
+	return append(queries, req.Queries...)
+}
+
+func validateQueries(queries []string) error {
+	for i, q := range queries {
+		if strings.TrimSpace(q) == "" {
+			return fmt.Errorf("queries[%d] is empty", i)
+		}
+	}
+	return nil
+}
+
+func newQueryRecords(queries []string) []QueryRecord {
+	records := make([]QueryRecord, len(queries))
+	for i, q := range queries {
+		records[i] = QueryRecord{SQL: q, Status: QueryPending}
+	}
+	return records
+}
+
+// 任务的查询记录；接收结果的协作方没有查询语句，按等待接收的结果个数生成
+func (req *RunPrivacyRequest) queryRecords() []QueryRecord {
+	if req.RunSQL == "" && req.receivesResult() {
+		return newQueryRecords(make([]string, req.expectedResults()))
+	}
+	return newQueryRecords(req.queries())
+}
+
+// 任务记录中的查询，旧的任务记录没有时按请求生成
+func (t *taskRunner) queries() ([]QueryRecord, error) {
+	rec, err := taskStore.Update(t.taskID, func(rec *TaskRecord) {
+		if len(rec.Queries) == 0 {
+			rec.Queries = t.req.queryRecords()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec.Queries, nil
+}
+
+// 更新第 i 条查询，任务记录顶层的结果字段同步为该查询
+func (t *taskRunner) updateQuery(i int, fn func(q *QueryRecord)) {
+	updateTask(t.taskID, func(rec *TaskRecord) {
+		if i >= len(rec.Queries) {
+			return
+		}
+		q := &rec.Queries[i]
+		fn(q)
+		rec.Attempts = q.Attempts
+		rec.JobID = q.JobID
+		rec.JobStatus = q.JobStatus
+		rec.RowCount = q.RowCount
+		if q.ResultPath != "" {
+			rec.ResultPath = q.ResultPath
+			rec.ResultFormat = q.ResultFormat
+			rec.ResultContentType = q.ResultContentType
+		}
+	})
+}
+
+// 在已有任务准备好的项目上执行查询的请求
+type RunQueriesRequest struct {
+	Queries      []string `json:"queries"`
+	QueryMode    string   `json:"query_mode,omitempty"`
+	ResultFormat string   `json:"result_format,omitempty"`
+
+	TimeoutSeconds int               `json:"timeout_seconds"`
+	PhaseTimeouts  map[TaskPhase]int `json:"phase_timeouts"`
+	// 只能设置 run_query、ready
+	Retry    map[string]RetryConfig `json:"retry,omitempty"`
+	Callback *TaskCallback          `json:"callback,omitempty"`
+}
+
+// 在已完成的发起方任务的项目上执行查询：创建新任务，跳过配置、导入、建项目和授权，
+// 直接从 QUERYING 开始，项目和表仍属于原任务
+func runQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	base, err := taskStore.Get(r.PathValue("id"))
+	if err == ErrTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if base.Request == nil || base.Request.RunSQL == "" || base.ProjectID == "" {
+		http.Error(w, "task is not an initiator task", http.StatusConflict)
+		return
+	}
+	if base.CleanedAt != nil {
+		http.Error(w, "task has been cleaned up", http.StatusConflict)
+		return
+	}
+	if base.Phase != PhaseSucceeded {
+		http.Error(w, fmt.Sprintf("project of task in phase %s is not ready", base.Phase), http.StatusConflict)
+		return
+	}
+
+	var body RunQueriesRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.Queries) == 0 {
+		http.Error(w, "missing queries", http.StatusBadRequest)
+		return
+	}
+	if err := validateQueries(body.Queries); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateResultFormat(body.ResultFormat); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateQueryMode(body.QueryMode); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.TimeoutSeconds < 0 {
+		http.Error(w, "timeout_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+	for phase, sec := range body.PhaseTimeouts {
+		if (phase != PhaseQuerying && phase != PhaseUploading) || sec < 0 {
+			http.Error(w, fmt.Sprintf("invalid phase timeout %s=%d", phase, sec), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := validateRetry(body.Retry, RetryRunQuery, RetryReady); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := body.Callback.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 其余参数沿用原任务
+	req := *base.Request
+	req.RunSQL, req.Queries = body.Queries[0], body.Queries[1:]
+	req.QueryMode = body.QueryMode
+	req.ResultFormat = body.ResultFormat
+	req.TimeoutSeconds = body.TimeoutSeconds
+	req.PhaseTimeouts = body.PhaseTimeouts
+	req.Retry = body.Retry
+	req.Callback = body.Callback
+	// 协作方的任务已结束，结果只交给本方
+	if req.Result != nil {
+		result := *req.Result
+		result.Receivers = nil
+		req.Result = &result
+	}
+
+	baseTaskID := base.ID
+	if base.BaseTaskID != "" {
+		baseTaskID = base.BaseTaskID
+		// 项目和表属于原任务，原任务清理后不能再查询
+		root, err := taskStore.Get(baseTaskID)
+		if err != nil {
+			http.Error(w, "get base task: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if root.CleanedAt != nil {
+			http.Error(w, "base task has been cleaned up", http.StatusConflict)
+			return
+		}
+	}
+	now := time.Now()
+	rec := &TaskRecord{
+		ID:         uuid.NewString(),
+		User:       req.User,
+		Data:       req.Data,
+		Phase:      PhasePending,
+		ProjectID:  base.ProjectID,
+		Table:      base.Table,
+		Queries:    newQueryRecords(req.queries()),
+		BaseTaskID: baseTaskID,
+		Request:    &req,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	req.Callback.stashSecret(rec.ID)
+	if err := taskStore.Create(rec); err != nil {
+		forgetCallbackSecret(rec.ID)
+		http.Error(w, "create task failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// 原任务清理前需等待这些任务结束
+	updateTask(baseTaskID, func(base *TaskRecord) {
+		base.QueryTasks = append(base.QueryTasks, rec.ID)
+	})
+	log.Infof("[task=%s] run %d queries on project %s of task %s", rec.ID, len(body.Queries), rec.ProjectID, baseTaskID)
+	go runTaskFrom(newTaskRunner(rec), PhaseQuerying)
+
+	resp := RunPrivacyResponse{
+		TaskID: rec.ID,
+		Status: "submitted",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 同时执行的任务数，环境变量 MAX_CONCURRENT_TASKS，默认 2
+const defaultMaxConcurrentTasks = 2
+
+var (
+	taskSlots   chan struct{}
+	queuedTasks atomic.Int64
+)
+
+func initTaskQueue() {
+	n := defaultMaxConcurrentTasks
+	if v, err := strconv.Atoi(os.Getenv("MAX_CONCURRENT_TASKS")); err == nil && v > 0 {
+		n = v
+	}
+	taskSlots = make(chan struct{}, n)
+	log.Infof("max concurrent tasks: %d", n)
+}
+
+// 获取执行槽位，没有空闲槽位时排队等待
+func acquireTaskSlot(ctx context.Context, taskID string) error {
+	select {
+	case taskSlots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	position := queuedTasks.Add(1)
+	defer queuedTasks.Add(-1)
+	emitEvent(taskID, EventQueued, map[string]int64{"position": position}, "waiting for a free slot, %d task(s) queued", position)
+
+	select {
+	case taskSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+func releaseTaskSlot() {
+	<-taskSlots
+}
+
+// 重启 broker 会中断正在调用 broker 的任务：任务在 CONFIGURING 之后的阶段共享使用 broker，
+// 重启需等待其他任务结束，等待重启时新的任务暂不进入这些阶段
+type brokerGate struct {
+	mu      sync.Mutex
+	users   int
+	restart bool
+	changed chan struct{} // 状态变化时关闭
+}
+
+var brokerUsers = &brokerGate{changed: make(chan struct{})}
+
+func (g *brokerGate) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// 共享使用 broker，有任务等待重启时先等待重启完成
+func (g *brokerGate) acquire(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.restart {
+		if err := g.waitLocked(ctx); err != nil {
+			return err
+		}
+	}
+	g.users++
+	return nil
+}
+
+func (g *brokerGate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.users--
+	g.notify()
+}
+
+// 等待其他任务都不再使用 broker 后独占 broker（重启 broker），之后需调用 unlockExclusive；
+// 同一时间只有一个任务独占，其余等待独占的任务依次排队
+func (g *brokerGate) lockExclusive(ctx context.Context, wait func(users int)) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.restart {
+		if err := g.waitLocked(ctx); err != nil {
+			return err
+		}
+	}
+	g.restart = true
+	for last := 0; g.users > 0; {
+		if g.users != last {
+			last = g.users
+			wait(last)
+		}
+		if err := g.waitLocked(ctx); err != nil {
+			g.restart = false
+			g.notify()
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *brokerGate) unlockExclusive() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.restart = false
+	g.notify()
+}
+
+// 调用方持有 g.mu：释放锁等待状态变化，返回前重新加锁
+func (g *brokerGate) waitLocked(ctx context.Context) error {
+	changed := g.changed
+	g.mu.Unlock()
+	defer g.mu.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireTaskSlot(t *testing.T) {
+	saved := taskSlots
+	taskSlots = make(chan struct{}, 2)
+	t.Cleanup(func() { taskSlots = saved })
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := acquireTaskSlot(ctx, "t"); err != nil {
+			t.Fatalf("acquire %d: %v", i, err)
+		}
+	}
+
+	// 没有空闲槽位时排队，直到有任务释放
+	acquired := make(chan error)
+	go func() { acquired <- acquireTaskSlot(ctx, "queued") }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquired without a free slot: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := queuedTasks.Load(); n != 1 {
+		t.Errorf("queued tasks = %d, want 1", n)
+	}
+	releaseTaskSlot()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("acquire after release: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued task not woken after release")
+	}
+
+	// 排队时 ctx 结束返回其原因
+	cause := errors.New("cancelled while queued")
+	cctx, cancel := context.WithCancelCause(ctx)
+	go func() { acquired <- acquireTaskSlot(cctx, "cancelled") }()
+	time.Sleep(20 * time.Millisecond)
+	cancel(cause)
+	select {
+	case err := <-acquired:
+		if !errors.Is(err, cause) {
+			t.Fatalf("err = %v, want %v", err, cause)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued task not woken by cancel")
+	}
+	if n := queuedTasks.Load(); n != 0 {
+		t.Errorf("queued tasks = %d, want 0", n)
+	}
+	if len(taskSlots) != 2 {
+		t.Errorf("slots in use = %d, want 2", len(taskSlots))
+	}
+}
+
+// 等待 ch 返回结果；超时表示仍在阻塞
+func waitResult(ch <-chan error, timeout time.Duration) (error, bool) {
+	select {
+	case err := <-ch:
+		return err, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+func TestBrokerGate(t *testing.T) {
+	g := &brokerGate{changed: make(chan struct{})}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := g.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 独占需等待所有共享使用的任务释放
+	var waits []int
+	exclusive := make(chan error, 1)
+	go func() {
+		exclusive <- g.lockExclusive(ctx, func(users int) { waits = append(waits, users) })
+	}()
+	if _, done := waitResult(exclusive, 50*time.Millisecond); done {
+		t.Fatal("exclusive acquired while broker in use")
+	}
+
+	// 等待独占时新的共享使用排在其后
+	shared := make(chan error, 1)
+	go func() { shared <- g.acquire(ctx) }()
+	if _, done := waitResult(shared, 50*time.Millisecond); done {
+		t.Fatal("shared acquired while restart pending")
+	}
+
+	g.release()
+	if _, done := waitResult(exclusive, 50*time.Millisecond); done {
+		t.Fatal("exclusive acquired with one user left")
+	}
+	g.release()
+	if err, done := waitResult(exclusive, time.Second); !done || err != nil {
+		t.Fatalf("exclusive after release: done %v, err %v", done, err)
+	}
+	if len(waits) != 2 || waits[0] != 2 || waits[1] != 1 {
+		t.Errorf("wait callbacks = %v, want [2 1]", waits)
+	}
+
+	// 独占期间其他独占排队，ctx 结束时返回其原因
+	cause := errors.New("task cancelled")
+	cctx, cancel := context.WithCancelCause(ctx)
+	go func() { exclusive <- g.lockExclusive(cctx, func(int) {}) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel(cause)
+	if err, done := waitResult(exclusive, time.Second); !done || !errors.Is(err, cause) {
+		t.Fatalf("queued exclusive: done %v, err %v, want %v", done, err, cause)
+	}
+
+	g.unlockExclusive()
+	if err, done := waitResult(shared, time.Second); !done || err != nil {
+		t.Fatalf("shared after restart: done %v, err %v", done, err)
+	}
+
+	// 等待共享使用的任务释放时 ctx 结束，放弃独占，不再阻塞共享使用
+	cctx, cancel = context.WithCancelCause(ctx)
+	go func() { exclusive <- g.lockExclusive(cctx, func(int) {}) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel(cause)
+	if err, done := waitResult(exclusive, time.Second); !done || !errors.Is(err, cause) {
+		t.Fatalf("exclusive waiting for users: done %v, err %v, want %v", done, err, cause)
+	}
+	if err, done := waitResult(goAcquire(g), time.Second); !done || err != nil {
+		t.Fatalf("shared after abandoned exclusive: done %v, err %v", done, err)
+	}
+	if g.users != 2 || g.restart {
+		t.Errorf("users = %d, restart = %v", g.users, g.restart)
+	}
+}
+
+func goAcquire(g *brokerGate) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- g.acquire(context.Background()) }()
+	return ch
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 任务阶段
+type TaskPhase string
+
+const (
+	PhasePending     TaskPhase = "PENDING"
+	PhaseConfiguring TaskPhase = "CONFIGURING"
+	PhaseLoadingData TaskPhase = "LOADING_DATA"
+	PhaseNegotiating TaskPhase = "NEGOTIATING"
+	PhaseGranting    TaskPhase = "GRANTING"
+	PhaseQuerying    TaskPhase = "QUERYING"
+	PhaseUploading   TaskPhase = "UPLOADING"
+	PhaseSucceeded   TaskPhase = "SUCCEEDED"
+	PhaseFailed      TaskPhase = "FAILED"
+	PhaseCancelled   TaskPhase = "CANCELLED"
+)
+
+// 合法的状态转换；PENDING 为排队中，可以进入任一阶段（从头执行或恢复执行），
+// FAILED 的任务恢复时重新排队
+var phaseTransitions = map[TaskPhase][]TaskPhase{
+	PhasePending:     {PhaseConfiguring, PhaseLoadingData, PhaseNegotiating, PhaseGranting, PhaseQuerying, PhaseUploading},
+	PhaseConfiguring: {PhaseLoadingData},
+	PhaseLoadingData: {PhaseNegotiating},
+	PhaseNegotiating: {PhaseGranting},
+	PhaseGranting:    {PhaseQuerying, PhaseSucceeded},
+	PhaseQuerying:    {PhaseUploading},
+	PhaseUploading:   {PhaseSucceeded},
+	PhaseFailed:      {PhasePending},
+}
+
+func (p TaskPhase) IsTerminal() bool {
+	return p == PhaseSucceeded || p == PhaseFailed || p == PhaseCancelled
+}
+
+func CanTransition(from, to TaskPhase) bool {
+	// 任何未结束的阶段都可以失败或取消
+	if !from.IsTerminal() && (to == PhaseFailed || to == PhaseCancelled) {
+		return true
+	}
+	for _, next := range phaseTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// 阶段执行记录
+type PhaseRecord struct {
+	Phase      TaskPhase  `json:"phase"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// 每个阶段的执行函数和超时时间
+type taskStep struct {
+	phase   TaskPhase
+	timeout time.Duration
+	run     func(t *taskRunner, ctx context.Context) error
+}
+
+var taskSteps = []taskStep{
+	{PhaseConfiguring, 5 * time.Minute, (*taskRunner).configure},
+	{PhaseLoadingData, 30 * time.Minute, (*taskRunner).loadData},
+	{PhaseNegotiating, 30 * time.Minute, (*taskRunner).negotiate},
+	{PhaseGranting, 10 * time.Minute, (*taskRunner).grant},
+	{PhaseQuerying, 30 * time.Minute, (*taskRunner).query},
+	{PhaseUploading, 10 * time.Minute, (*taskRunner).upload},
+}
+
+// 切换任务阶段，非法的状态转换返回错误
+func transitionTask(taskID string, to TaskPhase, cause error) error {
+	var terr error
+	rec, err := taskStore.Update(taskID, func(rec *TaskRecord) {
+		if !CanTransition(rec.Phase, to) {
+			terr = fmt.Errorf("invalid phase transition %s -> %s", rec.Phase, to)
+			return
+		}
+		now := time.Now()
+		if n := len(rec.Phases); n > 0 && rec.Phases[n-1].FinishedAt == nil {
+			rec.Phases[n-1].FinishedAt = &now
+			if cause != nil {
+				rec.Phases[n-1].Error = cause.Error()
+			}
+		}
+		// 排队时失败保留之前失败的阶段（恢复执行时从该阶段开始）
+		if to == PhaseFailed && rec.Phase != PhasePending {
+			rec.FailedPhase = rec.Phase
+		}
+		if cause != nil {
+			rec.LastError = cause.Error()
+			rec.ErrorCode = ""
+			var timeoutErr *PhaseTimeoutError
+			if errors.As(cause, &timeoutErr) {
+				rec.ErrorCode = timeoutErr.Code()
+			}
+			if errors.Is(cause, errTaskInterrupted) {
+				rec.ErrorCode = "TASK_INTERRUPTED"
+			}
+		}
+		if rec.StartedAt == nil {
+			rec.StartedAt = &now
+		}
+		if to.IsTerminal() {
+			rec.FinishedAt = &now
+		} else {
+			rec.FinishedAt = nil
+			rec.Phases = append(rec.Phases, PhaseRecord{Phase: to, StartedAt: now})
+		}
+		rec.Phase = to
+	})
+	if err != nil {
+		return err
+	}
+	if terr != nil {
+		return terr
+	}
+	emitPhase(taskID, to, cause)
+	// 任务结束后不再使用 broker，下次渲染时移除其参与方；恢复执行或在其项目上查询时重新加入
+	if to.IsTerminal() {
+		forgetParties(taskID)
+		go notifyCallback(rec)
+	}
+	return nil
+}
+
+var (
+	errTaskCancelled = errors.New("task cancelled")
+	errTaskTimeout   = errors.New("task timeout")
+	errPhaseTimeout  = errors.New("phase timeout")
+	// 服务重启时未结束的任务
+	errTaskInterrupted = errors.New("task interrupted by service restart")
+)
+
+// 阶段超时错误，Global 表示触发的是任务总超时
+type PhaseTimeoutError struct {
+	Phase   TaskPhase
+	Timeout time.Duration
+	Global  bool
+	Reason  error
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	if e.Global {
+		return fmt.Sprintf("task timed out after %s in phase %s: %v", e.Timeout, e.Phase, e.Reason)
+	}
+	return fmt.Sprintf("phase %s timed out after %s: %v", e.Phase, e.Timeout, e.Reason)
+}
+
+func (e *PhaseTimeoutError) Unwrap() error {
+	return e.Reason
+}
+
+// 错误类型，写入任务记录的 error_code
+func (e *PhaseTimeoutError) Code() string {
+	if e.Global {
+		return "TASK_TIMEOUT"
+	}
+	return "PHASE_TIMEOUT"
+}
+
+// 本进程中正在执行的任务，用于取消
+var (
+	runningMu    sync.Mutex
+	runningTasks = map[string]context.CancelCauseFunc{}
+)
+
+// 取消正在执行的任务，任务不在本进程执行时返回 false
+func cancelRunningTask(taskID string) bool {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	cancel, ok := runningTasks[taskID]
+	if ok {
+		cancel(errTaskCancelled)
+	}
+	return ok
+}
+
+// 任务是否在本进程中执行（含取消后的清理）
+func isTaskRunning(taskID string) bool {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	_, ok := runningTasks[taskID]
+	return ok
+}
+
+// 服务启动时间，早于该时间创建且未结束的任务已随上次进程退出而中断
+var serviceStartedAt = time.Now()
+
+// 将上次进程退出时未结束的任务标记为 FAILED，之后可以通过 resume 从中断的阶段恢复执行
+func failInterruptedTasks() error {
+	ids, err := taskStore.ListUnfinished(serviceStartedAt)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := transitionTask(id, PhaseFailed, errTaskInterrupted); err != nil {
+			log.Errorf("[task=%s] err:%s", id, err.Error())
+			continue
+		}
+		log.Infof("[task=%s] interrupted by restart, marked FAILED", id)
+	}
+	return nil
+}
+
+// MySQL 与本服务同时启动，任务存储不可用时定期重试
+func recoverInterruptedTasks() {
+	for {
+		err := failInterruptedTasks()
+		if err == nil {
+			return
+		}
+		log.Errorf("recover interrupted tasks err:%s", err.Error())
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// 阶段在 taskSteps 中的顺序，不在其中的返回 -1
+func phaseIndex(phase TaskPhase) int {
+	for i, step := range taskSteps {
+		if step.phase == phase {
+			return i
+		}
+	}
+	return -1
+}
+
+// 排队等待执行槽位后，从 from 阶段开始依次执行各阶段；任务需处于 PENDING
+func runTaskFrom(t *taskRunner, from TaskPhase) {
+	baseCtx := context.Background()
+	taskTimeout := time.Duration(t.req.TimeoutSeconds) * time.Second
+	if taskTimeout > 0 {
+		var cancel context.CancelFunc
+		baseCtx, cancel = context.WithTimeoutCause(baseCtx, taskTimeout, errTaskTimeout)
+		defer cancel()
+	}
+	taskCtx, cancelTask := context.WithCancelCause(baseCtx)
+	runningMu.Lock()
+	runningTasks[t.taskID] = cancelTask
+	runningMu.Unlock()
+	defer func() {
+		runningMu.Lock()
+		delete(runningTasks, t.taskID)
+		runningMu.Unlock()
+		cancelTask(nil)
+	}()
+
+	if err := acquireTaskSlot(taskCtx, t.taskID); err != nil {
+		// 排队时任务总超时：与执行阶段超时一样失败，而不是取消
+		if context.Cause(taskCtx) == errTaskTimeout {
+			err = &PhaseTimeoutError{Phase: PhasePending, Timeout: taskTimeout, Global: true, Reason: err}
+			log.Errorf("[task=%s] err:%s", t.taskID, err.Error())
+			if terr := transitionTask(t.taskID, PhaseFailed, err); terr != nil {
+				log.Errorf("[task=%s] err:%s", t.taskID, terr.Error())
+			}
+			return
+		}
+		log.Infof("[task=%s] cancelled while queued", t.taskID)
+		if terr := transitionTask(t.taskID, PhaseCancelled, err); terr != nil {
+			log.Errorf("[task=%s] err:%s", t.taskID, terr.Error())
+		}
+		return
+	}
+	defer releaseTaskSlot()
+	defer t.releaseBroker()
+
+	started := false
+	for _, step := range taskSteps {
+		if !started && step.phase != from {
+			continue
+		}
+		started = true
+		// 协作方没有查询语句，不接收结果时授权完成即结束
+		if step.phase == PhaseQuerying && t.req.RunSQL == "" && !t.req.receivesResult() {
+			log.Infof("[task=%s] RunSQL empty", t.taskID)
+			break
+		}
+		if err := transitionTask(t.taskID, step.phase, nil); err != nil {
+			log.Errorf("[task=%s] err:%s", t.taskID, err.Error())
+			return
+		}
+
+		// 渲染配置并登记参与方：从 CONFIGURING 之后的阶段开始（恢复执行、在已有项目上查询）时，
+		// 参与方可能已随其他任务的渲染移除；等待其他任务释放 broker 不计入阶段超时
+		var err error
+		if step.phase == from || step.phase == PhaseConfiguring {
+			err = t.prepareConfigure(taskCtx)
+		}
+		timeout := t.phaseTimeout(step)
+		ctx, cancel := context.WithTimeoutCause(taskCtx, timeout, errPhaseTimeout)
+		if err == nil && step.phase != PhaseConfiguring {
+			err = t.applyBrokerConfig(ctx)
+		}
+		if err == nil {
+			err = t.holdBroker(ctx, step.phase)
+		}
+		if err == nil {
+			err = step.run(t, ctx)
+		}
+		cause := context.Cause(ctx)
+		cancel()
+		// 部分阶段会忽略单次调用的错误，取消需单独检查
+		if context.Cause(taskCtx) == errTaskCancelled {
+			log.Infof("[task=%s] cancelled in %s", t.taskID, step.phase)
+			if terr := transitionTask(t.taskID, PhaseCancelled, errTaskCancelled); terr != nil {
+				log.Errorf("[task=%s] err:%s", t.taskID, terr.Error())
+			}
+			t.cleanup(step.phase)
+			return
+		}
+		if err != nil {
+			switch cause {
+			case errPhaseTimeout:
+				err = &PhaseTimeoutError{Phase: step.phase, Timeout: timeout, Reason: err}
+			case errTaskTimeout:
+				err = &PhaseTimeoutError{Phase: step.phase, Timeout: taskTimeout, Global: true, Reason: err}
+			default:
+				err = fmt.Errorf("%s: %w", step.phase, err)
+			}
+			log.Errorf("[task=%s] err:%s", t.taskID, err.Error())
+			if terr := transitionTask(t.taskID, PhaseFailed, err); terr != nil {
+				log.Errorf("[task=%s] err:%s", t.taskID, terr.Error())
+			}
+			return
+		}
+	}
+	if err := transitionTask(t.taskID, PhaseSucceeded, nil); err != nil {
+		log.Errorf("[task=%s] err:%s", t.taskID, err.Error())
+		return
+	}
+	if t.req.AutoCleanup {
+		t.autoCleanup()
+	}
+}
+
+// 阶段超时：请求中的 phase_timeouts 优先，否则使用默认值
+func (t *taskRunner) phaseTimeout(step taskStep) time.Duration {
+	if sec, ok := t.req.PhaseTimeouts[step.phase]; ok && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	return step.timeout
+}
+
+// 等待 d，ctx 结束时提前返回
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// 等待失败时带上最后一次的错误，便于定位原因
+func waitErr(ctx context.Context, lastErr error) error {
+	if lastErr != nil {
+		return fmt.Errorf("%w: last error: %v", ctx.Err(), lastErr)
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to TaskPhase
+		want     bool
+	}{
+		{PhasePending, PhaseConfiguring, true},
+		{PhasePending, PhaseQuerying, true}, // 从失败阶段恢复执行
+		{PhasePending, PhaseSucceeded, false},
+		{PhaseConfiguring, PhaseLoadingData, true},
+		{PhaseLoadingData, PhaseNegotiating, true},
+		{PhaseNegotiating, PhaseGranting, true},
+		{PhaseGranting, PhaseQuerying, true},
+		{PhaseGranting, PhaseSucceeded, true}, // 协作方不执行查询
+		{PhaseQuerying, PhaseUploading, true},
+		{PhaseUploading, PhaseSucceeded, true},
+		{PhaseConfiguring, PhaseNegotiating, false}, // 不能跳过阶段
+		{PhaseQuerying, PhaseGranting, false},       // 不能回退
+		{PhaseQuerying, PhaseSucceeded, false},
+		{PhaseLoadingData, PhaseFailed, true},
+		{PhaseUploading, PhaseCancelled, true},
+		{PhasePending, PhaseCancelled, true},
+		{PhaseFailed, PhasePending, true}, // 恢复执行
+		{PhaseFailed, PhaseConfiguring, false},
+		{PhaseFailed, PhaseCancelled, false},
+		{PhaseSucceeded, PhasePending, false},
+		{PhaseSucceeded, PhaseFailed, false},
+		{PhaseCancelled, PhasePending, false},
+		{PhaseCancelled, PhaseFailed, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransition(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestTransitionTask(t *testing.T) {
+	saved := taskStore
+	taskStore = NewMemoryTaskStore()
+	t.Cleanup(func() { taskStore = saved })
+
+	if err := taskStore.Create(&TaskRecord{ID: "t1", Phase: PhasePending}); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		to      TaskPhase
+		cause   error
+		wantErr bool
+	}{
+		{PhaseConfiguring, nil, false},
+		{PhaseNegotiating, nil, true},
+		{PhaseLoadingData, nil, false},
+		{PhaseFailed, errors.New("boom"), false},
+		{PhaseQuerying, nil, true},
+		{PhasePending, nil, false},
+	}
+	for _, step := range steps {
+		err := transitionTask("t1", step.to, step.cause)
+		if (err != nil) != step.wantErr {
+			t.Fatalf("transition to %s: err = %v, wantErr %v", step.to, err, step.wantErr)
+		}
+	}
+
+	rec, err := taskStore.Get("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Phase != PhasePending || rec.FailedPhase != PhaseLoadingData || rec.LastError != "boom" {
+		t.Errorf("phase = %s, failed_phase = %s, last_error = %q", rec.Phase, rec.FailedPhase, rec.LastError)
+	}
+	var phases []TaskPhase
+	for _, p := range rec.Phases {
+		phases = append(phases, p.Phase)
+	}
+	want := []TaskPhase{PhaseConfiguring, PhaseLoadingData, PhasePending}
+	if len(phases) != len(want) {
+		t.Fatalf("phases = %v, want %v", phases, want)
+	}
+	for i := range want {
+		if phases[i] != want[i] {
+			t.Fatalf("phases = %v, want %v", phases, want)
+		}
+	}
+	if rec.Phases[1].Error != "boom" || rec.Phases[1].FinishedAt == nil {
+		t.Errorf("failed phase record = %+v", rec.Phases[1])
+	}
+}
+
+func TestFailInterruptedTasks(t *testing.T) {
+	saved := taskStore
+	taskStore = NewMemoryTaskStore()
+	t.Cleanup(func() { taskStore = saved })
+
+	before := serviceStartedAt.Add(-time.Minute)
+	tasks := []struct {
+		id        string
+		phase     TaskPhase
+		createdAt time.Time
+		want      TaskPhase
+		failed    TaskPhase // 恢复执行的起始阶段
+	}{
+		{"queued", PhasePending, before, PhaseFailed, ""},
+		{"loading", PhaseLoadingData, before, PhaseFailed, PhaseLoadingData},
+		{"querying", PhaseQuerying, before, PhaseFailed, PhaseQuerying},
+		{"done", PhaseSucceeded, before, PhaseSucceeded, ""},
+		{"cancelled", PhaseCancelled, before, PhaseCancelled, ""},
+		// 本进程启动后提交的任务
+		{"new", PhaseLoadingData, time.Now(), PhaseLoadingData, ""},
+	}
+	for _, task := range tasks {
+		if err := taskStore.Create(&TaskRecord{ID: task.id, Phase: task.phase, CreatedAt: task.createdAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := failInterruptedTasks(); err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range tasks {
+		rec, err := taskStore.Get(task.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Phase != task.want {
+			t.Errorf("%s: phase = %s, want %s", task.id, rec.Phase, task.want)
+			continue
+		}
+		if task.want == PhaseFailed && (rec.FailedPhase != task.failed || rec.ErrorCode != "TASK_INTERRUPTED") {
+			t.Errorf("%s: failed_phase = %s, error_code = %s", task.id, rec.FailedPhase, rec.ErrorCode)
+		}
+	}
+}
+
+func TestTransitionForgetsParties(t *testing.T) {
+	saved, savedParties := taskStore, activeParties
+	taskStore = NewMemoryTaskStore()
+	activeParties = map[string]taskParties{}
+	t.Cleanup(func() { taskStore, activeParties = saved, savedParties })
+
+	for _, to := range []TaskPhase{PhaseSucceeded, PhaseFailed, PhaseCancelled} {
+		id := "t-" + string(to)
+		if err := taskStore.Create(&TaskRecord{ID: id, Phase: PhaseQuerying}); err != nil {
+			t.Fatal(err)
+		}
+		brokerConfigFromRequest(id, &RunPrivacyRequest{User: "alice", Parties: []Party{{User: "bob"}}})
+		if to == PhaseSucceeded {
+			transitionTask(id, PhaseUploading, nil)
+		}
+		if err := transitionTask(id, to, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := activeParties[id]; ok {
+			t.Errorf("parties of %s task not forgotten", to)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrTaskNotFound = errors.New("task not found")
+
+// 任务记录：保存任务的阶段、时间戳、错误和结果路径
+type TaskRecord struct {
+	ID          string        `json:"task_id"`
+	User        string        `json:"user"`
+	Data        string        `json:"data"`
+	ProjectID   string        `json:"project_id,omitempty"`
+	Table       string        `json:"table,omitempty"`
+	Phase       TaskPhase     `json:"phase"`
+	FailedPhase TaskPhase     `json:"failed_phase,omitempty"`
+	Phases      []PhaseRecord `json:"phases,omitempty"`
+	Attempts    int           `json:"attempts"`
+	LastError   string        `json:"last_error,omitempty"`
+	ErrorCode   string        `json:"error_code,omitempty"`
+	ResultPath  string        `json:"result_path,omitempty"`
+	RowCount    int64         `json:"row_count"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	StartedAt   *time.Time    `json:"started_at,omitempty"`
+	FinishedAt  *time.Time    `json:"finished_at,omitempty"`
+
+	// 数据下载和导入进度
+	Progress *TaskProgress `json:"progress,omitempty"`
+	// 数据导入结果：列类型和被拒绝的行
+	Dataset *DatasetReport `json:"dataset,omitempty"`
+	// 结果文件格式和 Content-Type
+	ResultFormat      string `json:"result_format,omitempty"`
+	ResultContentType string `json:"result_content_type,omitempty"`
+	// 异步查询的作业 ID，可用于再次获取结果；JobStatus 为执行中作业的状态
+	JobID     string          `json:"job_id,omitempty"`
+	JobStatus *QueryJobStatus `json:"job_status,omitempty"`
+	// 各条查询的状态和结果；顶层的结果字段与最近更新的查询相同
+	Queries []QueryRecord `json:"queries,omitempty"`
+	// 在已有任务的项目上执行查询时，项目和表所属的任务
+	BaseTaskID string `json:"base_task_id,omitempty"`
+	// 在本任务的项目上执行查询的任务
+	QueryTasks []string `json:"query_tasks,omitempty"`
+	// 协作方接受的邀请
+	Invitation *InvitationRecord `json:"invitation,omitempty"`
+	// 重试过的操作的尝试次数和最近的错误，key 为操作名，如 inviteMember bob
+	Retries map[string]*RetryStatus `json:"retries,omitempty"`
+	// 任务结束后清理项目中的表和本地数据的时间，清理后不能再恢复执行
+	CleanedAt *time.Time `json:"cleaned_at,omitempty"`
+
+	// 回调投递结果：delivered / failed
+	CallbackStatus string `json:"callback_status,omitempty"`
+	CallbackError  string `json:"callback_error,omitempty"`
+
+	// 原始请求，用于恢复执行
+	Request *RunPrivacyRequest `json:"request,omitempty"`
+}
+
+// 数据下载和导入进度，Stage 为 download / load
+type TaskProgress struct {
+	Stage     string    `json:"stage"`
+	Bytes     int64     `json:"bytes"`
+	Rows      int64     `json:"rows"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TaskStore 任务存储接口
+type TaskStore interface {
+	Create(rec *TaskRecord) error
+	Get(id string) (*TaskRecord, error)
+	// Update 在存储内原子地修改记录，返回修改后的副本
+	Update(id string, fn func(rec *TaskRecord)) (*TaskRecord, error)
+	// ListUnfinished 返回创建时间早于 before 且未结束的任务 ID
+	ListUnfinished(before time.Time) ([]string, error)
+}
+
+var taskStore TaskStore
+
+// 根据环境变量 TASK_STORE 选择存储：memory / mysql（默认）
+func NewTaskStore() TaskStore {
+	switch os.Getenv("TASK_STORE") {
+	case "memory":
+		return NewMemoryTaskStore()
+	default:
+		return NewMySQLTaskStore(dsn)
+	}
+}
+
+// ================================
+// 内存存储
+// ================================
+type MemoryTaskStore struct {
+	mu    sync.RWMutex
+	tasks map[string]*TaskRecord
+}
+
+func NewMemoryTaskStore() *MemoryTaskStore {
+	return &MemoryTaskStore{tasks: make(map[string]*TaskRecord)}
+}
+
+func (s *MemoryTaskStore) Create(rec *TaskRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[rec.ID] = cloneTask(rec)
+	return nil
+}
+
+func (s *MemoryTaskStore) Get(id string) (*TaskRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	return cloneTask(rec), nil
+}
+
+func (s *MemoryTaskStore) Update(id string, fn func(rec *TaskRecord)) (*TaskRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	fn(rec)
+	rec.UpdatedAt = time.Now()
+	return cloneTask(rec), nil
+}
+
+func (s *MemoryTaskStore) ListUnfinished(before time.Time) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ids []string
+	for id, rec := range s.tasks {
+		if !rec.Phase.IsTerminal() && rec.CreatedAt.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// 通过 JSON 深拷贝，保证与 MySQL 存储的语义一致
+func cloneTask(rec *TaskRecord) *TaskRecord {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		cp := *rec
+		return &cp
+	}
+	var cp TaskRecord
+	if err := json.Unmarshal(data, &cp); err != nil {
+		cp = *rec
+	}
+	return &cp
+}
+
+// ================================
+// MySQL 存储（engine.privacy_tasks）
+// ================================
+const createTaskTableSQL = `
+	CREATE TABLE IF NOT EXISTS privacy_tasks (
+		id varchar(64) NOT NULL,
+		phase varchar(32) NOT NULL,
+		record longtext NOT NULL,
+		created_at timestamp(6) NULL DEFAULT NULL,
+		updated_at timestamp(6) NULL DEFAULT NULL,
+		PRIMARY KEY (id)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`
+
+type MySQLTaskStore struct {
+	dsn string
+
+	mu     sync.Mutex
+	inited bool
+}
+
+func NewMySQLTaskStore(dsn string) *MySQLTaskStore {
+	return &MySQLTaskStore{dsn: dsn}
+}
+
+// MySQL 由 supervisord 与本服务同时启动，建表延迟到第一次使用时
+func (s *MySQLTaskStore) getDB() (*sql.DB, error) {
+	db, err := GetDB(s.dsn)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.inited {
+		if err := ExecSQL(db, createTaskTableSQL); err != nil {
+			return nil, err
+		}
+		s.inited = true
+	}
+	return db, nil
+}
+
+func (s *MySQLTaskStore) Create(rec *TaskRecord) error {
+	db, err := s.getDB()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return ExecSQL(db, "INSERT INTO privacy_tasks (id, phase, record, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		rec.ID, rec.Phase, string(data), rec.CreatedAt, rec.UpdatedAt)
+}
+
+func (s *MySQLTaskStore) Get(id string) (*TaskRecord, error) {
+	db, err := s.getDB()
+	if err != nil {
+		return nil, err
+	}
+	var data string
+	err = db.QueryRow("SELECT record FROM privacy_tasks WHERE id = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec TaskRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *MySQLTaskStore) Update(id string, fn func(rec *TaskRecord)) (*TaskRecord, error) {
+	db, err := s.getDB()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var data string
+	err = tx.QueryRow("SELECT record FROM privacy_tasks WHERE id = ? FOR UPDATE", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec TaskRecord
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		return nil, err
+	}
+	fn(&rec)
+	rec.UpdatedAt = time.Now()
+
+	out, err := json.Marshal(&rec)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE privacy_tasks SET phase = ?, record = ?, updated_at = ? WHERE id = ?",
+		rec.Phase, string(out), rec.UpdatedAt, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *MySQLTaskStore) ListUnfinished(before time.Time) ([]string, error) {
+	db, err := s.getDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT id FROM privacy_tasks WHERE phase NOT IN (?, ?, ?) AND created_at < ?",
+		PhaseSucceeded, PhaseFailed, PhaseCancelled, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// 更新任务记录，失败只记录日志，不中断任务
+func updateTask(taskID string, fn func(rec *TaskRecord)) {
+	if _, err := taskStore.Update(taskID, fn); err != nil {
+		log.Errorf("[task=%s] update task record err:%s", taskID, err.Error())
+	}
+}
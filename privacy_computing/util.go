@@ -1,19 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
-	"strings"
-	"time"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func RunCmd(cmd string) error {
-	c := exec.Command("/bin/sh", "-c", cmd)
+func RunCmd(ctx context.Context, cmd string) error {
+	c := exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
 	output, err := c.CombinedOutput() // 等待命令结束，并返回 stdout/stderr
 	if err != nil {
 		log.Error("Command error:", cmd, err.Error())
@@ -23,6 +24,36 @@ func RunCmd(cmd string) error {
 	return nil
 }
 
+// 移动文件，跨文件系统（EXDEV）时复制后删除源文件
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
 func FileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil || !os.IsNotExist(err)
@@ -42,22 +73,6 @@ func GetIp(domain string) string {
 	}
 	return domain
 }
-func IsPortOpen(port string) bool {
-	// 默认检查本地主机
-	const host = "127.0.0.1"
-	const timeout = 2 * time.Second // 设置连接超时时间为 2 秒
-	address := net.JoinHostPort(host, port)
-	conn, err := net.DialTimeout("tcp", address, timeout)
-	if err != nil {
-		fmt.Printf("DEBUG: Connection to %s failed: %v\n", address, err)
-		return false
-	}
-	if conn != nil {
-		conn.Close()
-		return true
-	}
-	return false
-}
 
 func CopyFile(src, dst string) (written int64, err error) {
 	sourceFile, err := os.Open(src)
@@ -79,14 +94,3 @@ func CopyFile(src, dst string) (written int64, err error) {
 	}
 	return written, nil
 }
-func replaceInFile(path string, replacements map[string]string) error {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return err
-	}
-	content := string(data)
-	for old, newVal := range replacements {
-		content = strings.ReplaceAll(content, old, newVal)
-	}
-	return os.WriteFile(path, []byte(content), 0644)
-}